@@ -0,0 +1,100 @@
+// Package boltmqtt provides session persistence with bbolt.
+// See https://github.com/etcd-io/bbolt for details.
+package boltmqtt
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// All entries reside in one bucket.
+var bucketName = []byte("mqtt")
+
+// Store implements mqtt.Persistence with a bbolt file. Each value is saved
+// under the 17-bit key, encoded as 3 bytes in big-endian order. Every Save and
+// Delete commits (with fsync) before return.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open installs a Store at path. The file is created when absent. Open fails
+// when another process holds the file lock for longer than a second.
+func Open(path string, mode os.FileMode) (*Store, error) {
+	db, err := bolt.Open(path, mode, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db}, nil
+}
+
+// Close releases all resources, including the file lock.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func encodeKey(key uint) []byte {
+	return []byte{byte(key >> 16), byte(key >> 8), byte(key)}
+}
+
+// Load implements the mqtt.Persistence interface.
+func (s *Store) Load(key uint) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketName).Get(encodeKey(key))
+		if v != nil {
+			// only valid during transaction
+			value = append(make([]byte, 0, len(v)), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Save implements the mqtt.Persistence interface.
+func (s *Store) Save(key uint, value net.Buffers) error {
+	var size int
+	for _, buf := range value {
+		size += len(buf)
+	}
+	v := make([]byte, 0, size)
+	for _, buf := range value {
+		v = append(v, buf...)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Put(encodeKey(key), v)
+	})
+}
+
+// Delete implements the mqtt.Persistence interface.
+func (s *Store) Delete(key uint) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Delete(encodeKey(key))
+	})
+}
+
+// List implements the mqtt.Persistence interface.
+func (s *Store) List() (keys []uint, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).ForEach(func(k, _ []byte) error {
+			if len(k) != 3 {
+				return errors.New("boltmqtt: foreign key in bucket")
+			}
+			keys = append(keys, uint(k[0])<<16|uint(k[1])<<8|uint(k[2]))
+			return nil
+		})
+	})
+	return keys, err
+}
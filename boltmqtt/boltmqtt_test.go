@@ -0,0 +1,59 @@
+package boltmqtt
+
+import (
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.db")
+	s, err := Open(path, 0o600)
+	if err != nil {
+		t.Fatal("open error:", err)
+	}
+
+	for key, value := range map[uint]string{
+		0:       "client",
+		0xc001:  "exactly once",
+		0x1ffff: "remote",
+	} {
+		err := s.Save(key, net.Buffers{[]byte(value[:2]), []byte(value[2:])})
+		if err != nil {
+			t.Fatalf("save %#05x error: %s", key, err)
+		}
+	}
+	if err := s.Delete(0xc001); err != nil {
+		t.Fatal("delete error:", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("close error:", err)
+	}
+
+	// reopen
+	s, err = Open(path, 0o600)
+	if err != nil {
+		t.Fatal("reopen error:", err)
+	}
+	defer s.Close()
+
+	keys, err := s.List()
+	if err != nil {
+		t.Fatal("list error:", err)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if len(keys) != 2 || keys[0] != 0 || keys[1] != 0x1ffff {
+		t.Errorf("got keys %#x, want [0x0 0x1ffff]", keys)
+	}
+	if got, err := s.Load(0x1ffff); err != nil {
+		t.Error("load error:", err)
+	} else if string(got) != "remote" {
+		t.Errorf("got %q, want \"remote\"", got)
+	}
+	if got, err := s.Load(0xc001); err != nil {
+		t.Error("load deleted error:", err)
+	} else if got != nil {
+		t.Errorf("got %q for deleted key, want nil", got)
+	}
+}
@@ -0,0 +1,9 @@
+module github.com/go-mqtt/mqtt/boltmqtt
+
+// The root module stays at go 1.16. This one needs go 1.17 for the
+// golang.org/x/sys release with current platform support.
+go 1.17
+
+require go.etcd.io/bbolt v1.3.6
+
+require golang.org/x/sys v0.10.0 // indirect
@@ -9,8 +9,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,24 +32,28 @@ var ErrClosed = errors.New("mqtt: client closed")
 // ErrBrokerTerm signals connection loss for unknown reasons.
 var errBrokerTerm = fmt.Errorf("mqtt: broker closed the connection (%w)", io.EOF)
 
-// ErrProtoReset signals illegal reception.
-var errProtoReset = errors.New("mqtt: connection reset on protocol violation by the broker")
+// ErrPongLost signals connection reset on a missing PINGRESP.
+var errPongLost = errors.New("mqtt: connection reset on PINGRESP absence within the keep-alive")
+
+// ErrProtocol signals illegal reception from the broker, which causes the
+// connection to reset. Errors match ErrProtocol with errors.Is.
+var ErrProtocol = errors.New("mqtt: connection reset on protocol violation by the broker")
 
 // “SUBSCRIBE, UNSUBSCRIBE, and PUBLISH (in cases where QoS > 0) Control Packets
 // MUST contain a non-zero 16-bit Packet Identifier.”
 // — MQTT Version 3.1.1, conformance statement MQTT-2.3.1-1
-var errPacketIDZero = fmt.Errorf("%w: packet identifier zero", errProtoReset)
+var errPacketIDZero = fmt.Errorf("%w: packet identifier zero", ErrProtocol)
 
 // A broker may send none of these packet types.
 var (
-	errRESERVED0      = fmt.Errorf("%w: reserved packet type 0 is forbidden", errProtoReset)
-	errGotCONNECT     = fmt.Errorf("%w: inbound CONNECT packet", errProtoReset)
-	errCONNACKTwo     = fmt.Errorf("%w: second CONNACK packet", errProtoReset)
-	errGotSUBSCRIBE   = fmt.Errorf("%w: inbound SUBSCRIBE packet", errProtoReset)
-	errGotUNSUBSCRIBE = fmt.Errorf("%w: inbound UNSUBSCRIBE packet", errProtoReset)
-	errGotPINGREQ     = fmt.Errorf("%w: inbound PINGREQ packet", errProtoReset)
-	errGotDISCONNECT  = fmt.Errorf("%w: inbound DISCONNECT packet", errProtoReset)
-	errRESERVED15     = fmt.Errorf("%w: reserved packet type 15 is forbidden", errProtoReset)
+	errRESERVED0      = fmt.Errorf("%w: reserved packet type 0 is forbidden", ErrProtocol)
+	errGotCONNECT     = fmt.Errorf("%w: inbound CONNECT packet", ErrProtocol)
+	errCONNACKTwo     = fmt.Errorf("%w: second CONNACK packet", ErrProtocol)
+	errGotSUBSCRIBE   = fmt.Errorf("%w: inbound SUBSCRIBE packet", ErrProtocol)
+	errGotUNSUBSCRIBE = fmt.Errorf("%w: inbound UNSUBSCRIBE packet", ErrProtocol)
+	errGotPINGREQ     = fmt.Errorf("%w: inbound PINGREQ packet", ErrProtocol)
+	errGotDISCONNECT  = fmt.Errorf("%w: inbound DISCONNECT packet", ErrProtocol)
+	errRESERVED15     = fmt.Errorf("%w: reserved packet type 15 is forbidden", ErrProtocol)
 )
 
 // Dialer abstracts the transport layer establishment.
@@ -55,6 +61,7 @@ type Dialer func(ctx context.Context) (net.Conn, error)
 
 // NewDialer provides plain network connections.
 // See net.Dial for details on the network & address syntax.
+// Unix domain sockets go with network "unix" and a file path as address.
 func NewDialer(network, address string) Dialer {
 	return func(ctx context.Context) (net.Conn, error) {
 		// minimize timer use; covered by PauseTimeout
@@ -63,8 +70,27 @@ func NewDialer(network, address string) Dialer {
 	}
 }
 
+// ErrConnUsed is the Dialer error from NewConnDialer after the first use.
+var ErrConnUsed = errors.New("mqtt: connection from NewConnDialer used already")
+
+// NewConnDialer provides conn on the first invocation only. Any following
+// invocation gets ErrConnUsed, without dialing. The Client closes conn on Close,
+// and on connection loss. Each ReadSlices after a connection loss attempts to
+// reconnect, which fails with ErrConnUsed, including Config.AutoReconnect with
+// its backoff. Close is the only way out at that point.
+func NewConnDialer(conn net.Conn) Dialer {
+	var used uint32
+	return func(context.Context) (net.Conn, error) {
+		if !atomic.CompareAndSwapUint32(&used, 0, 1) {
+			return nil, ErrConnUsed
+		}
+		return conn, nil
+	}
+}
+
 // NewTLSDialer provides secured network connections.
 // See net.Dial for details on the network & address syntax.
+// The TLS handshake is part of the dial, and so is Config.PauseTimeout.
 func NewTLSDialer(network, address string, config *tls.Config) Dialer {
 	return func(ctx context.Context) (net.Conn, error) {
 		dialer := tls.Dialer{
@@ -76,6 +102,31 @@ func NewTLSDialer(network, address string, config *tls.Config) Dialer {
 	}
 }
 
+// NewStrictTLSDialer is like NewTLSDialer, yet it enforces a minimum protocol
+// version, like tls.VersionTLS12 or tls.VersionTLS13, and it refuses any
+// renegotiation. The config is copied, and it may be nil.
+func NewStrictTLSDialer(network, address string, config *tls.Config, minVersion uint16) Dialer {
+	if config == nil {
+		config = new(tls.Config)
+	} else {
+		config = config.Clone()
+	}
+	if config.MinVersion < minVersion {
+		config.MinVersion = minVersion
+	}
+	config.Renegotiation = tls.RenegotiateNever
+	return NewTLSDialer(network, address, config)
+}
+
+// Metrics receives notice of each packet transferred, with the packet type as
+// kind (e.g., 3 for PUBLISH), and the number of bytes on the wire as size. The
+// callbacks are invoked in line with network I/O. Implementations should be
+// fast, and they must be safe for concurrent use.
+type Metrics interface {
+	OnPacketRead(kind byte, size int)
+	OnPacketWrite(kind byte, size int)
+}
+
 // Config is a Client configuration. Dialer is the only required field.
 type Config struct {
 	Dialer // chooses the broker
@@ -91,10 +142,17 @@ type Config struct {
 	// net.Error with Timeout true.
 	PauseTimeout time.Duration
 
+	// ReadPauseTimeout and WritePauseTimeout override PauseTimeout for
+	// inbound and outbound transfers respectively. Zero defaults to the
+	// PauseTimeout. Negative values disable timeout protection for the
+	// direction, e.g., for brokers which pause reads during maintenance.
+	ReadPauseTimeout, WritePauseTimeout time.Duration
+
 	// The maximum number of transactions at a time. Excess is denied with
 	// ErrMax. Zero effectively disables the respective quality-of-service
 	// level. Negative values default to the Client limit of 16,384. Higher
-	// values are truncated silently.
+	// values are truncated silently. With ProtocolLevel 5, the Receive
+	// Maximum from the broker, if any, limits both levels combined.
 	AtLeastOnceMax, ExactlyOnceMax int
 
 	// The user name may be used by the broker for authentication and/or
@@ -105,51 +163,201 @@ type Config struct {
 
 	// The Will Message is published when the connection terminates
 	// without Disconnect. A nil Message disables the Will option.
-	Will struct {
-		Topic   string // destination
-		Message []byte // payload
-
-		Retain      bool // see PublishRetained
-		AtLeastOnce bool // see PublishAtLeastOnce
-		ExactlyOnce bool // overrides AtLeastOnce
-	}
-
-	KeepAlive uint16 // timeout in seconds (disabled with zero)
+	// See Client.SetWill for updates.
+	Will Will
+
+	// KeepAlive is the timeout in seconds, with zero for disabled. The
+	// Client sends a PINGREQ once no other packet was sent for the period.
+	// The connection resets when no PINGRESP follows within the period.
+	KeepAlive uint16
+
+	// ProtocolLevel selects the MQTT version, with 4 for version 3.1.1,
+	// and 5 for version 5.0. Zero defaults to 4. Version 5.0 sessions
+	// without CleanSession never expire, like in version 3.1.1.
+	ProtocolLevel byte
+
+	// TopicAliasMax permits the broker to replace topics of inbound PUBLISH
+	// with a number from 1 up to and including the limit. Zero disables the
+	// option. It requires ProtocolLevel 5.
+	TopicAliasMax uint16
+
+	// DropRetained discards inbound messages with the retain flag set for
+	// the given duration after each SUBACK. The approach is a heuristic for
+	// brokers without retain handling [MQTT 3.1.1], as live messages may be
+	// retained too, and retained messages may arrive late. Messages remain
+	// acknowledged. BigMessage is not affected. Zero disables the option.
+	DropRetained time.Duration
 
 	// Brokers must resume communications with the client (identified by
 	// ClientID) when CleanSession is false. Otherwise, brokers must create
 	// a new session when either CleanSession is true or when no session is
 	// associated to the client identifier.
 	CleanSession bool
+
+	// ClientIDGenerator provides the client identifier when a session gets
+	// initiated with an empty one. See RandomClientID for an option. Nil
+	// leaves the empty identifier as is, for the broker to assign one.
+	ClientIDGenerator func() string
+
+	// ConnectRetry makes the first connect [ReadSlices] try again on failure
+	// for up to the given duration. The delay between attempts starts with
+	// RetryDelay, or 100 ms when zero, and it doubles on each failure. Zero
+	// ConnectRetry disables the option. Any IsConnectionRefused other than
+	// ErrUnavailable is considered to be permanent, and thus not retried.
+	ConnectRetry time.Duration
+	RetryDelay   time.Duration
+
+	// Subscriptions are resent after each reconnect, because the broker may
+	// have lost the session in the mean time. The same goes for the first
+	// connect with ImportSubscriptions. A CONNACK with the session present
+	// flag skips resubscription, as the broker has the subscriptions still.
+	// NoResubscribe disables this option, for when subscription is managed
+	// by the application.
+	NoResubscribe bool
+
+	// AutoReconnect makes ReadSlices wait before each connect attempt that
+	// follows a failed one, as a backoff. The delay starts with RetryDelay,
+	// or 100 ms when zero, and it doubles on each failure up to
+	// RetryDelayMax, or 30 s when zero. A successful connect resets the
+	// delay. Requests receive ErrDown in the mean time.
+	AutoReconnect bool
+	RetryDelayMax time.Duration
+
+	// Warn receives notice on questionable use, like publishing with an
+	// “at least once” or an “exactly once” guarantee on a VolatileSession.
+	// Each kind of warning is issued only once per Client, with HoldTimeout
+	// as the exception. Nil discards.
+	Warn func(error)
+
+	// HoldTimeout limits the time between the ReadSlices return of a message
+	// with an “exactly once” guarantee, and the next ReadSlices call, which
+	// confirms reception to the broker. Expiry passes an error to Warn, for
+	// each message, from another routine. The message remains on hold. Zero
+	// disables the option.
+	HoldTimeout time.Duration
+
+	// CloseGrace permits a packet submission in progress to complete on
+	// Close, for up to the duration. Zero closes the connection without
+	// delay, which may cut off a packet in transit. Shutdowns take up to
+	// CloseGrace longer in exchange.
+	CloseGrace time.Duration
+
+	// OnReserve and OnFree receive the packet identifiers of outbound
+	// requests [publish with a guarantee, subscribe and unsubscribe] on
+	// assignment and on release respectively, e.g., to trace ErrMax. The
+	// exchanges restored by AdoptSession get no OnReserve. The hooks are
+	// called from any goroutine. They must not block. Nil disables.
+	OnReserve, OnFree func(packetID uint)
+
+	// OnExactlyOnceComplete receives the packet identifier of each inbound
+	// PUBLISH with an “exactly once” guarantee, once the PUBCOMP is sent.
+	// The broker won't redeliver the message from then on. The hook runs
+	// from within ReadSlices, always after the message was returned by an
+	// earlier ReadSlices. Messages dropped by DropRetained get no hook.
+	// See MessageInfo for the packet identifier per message. Retransmission of
+	// PUBREL by the broker may repeat the hook for a packet identifier. It
+	// must not block. Nil disables.
+	OnExactlyOnceComplete func(packetID uint)
+
+	// Metrics receives notice of each packet transferred. Nil disables.
+	Metrics Metrics
+
+	// MaxSessionDuration limits the lifetime of each connection. Expiry
+	// causes a Disconnect, followed by a reconnect from ReadSlices, as in
+	// a fresh handshake. Zero disables the option.
+	MaxSessionDuration time.Duration
 }
 
 func (c *Config) valid() error {
 	if c.Dialer == nil {
 		return errors.New("mqtt: no Dialer in Config")
 	}
+	switch c.ProtocolLevel {
+	case 0, 4, 5:
+		break
+	default:
+		return fmt.Errorf("mqtt: protocol level %d not supported", c.ProtocolLevel)
+	}
+	if c.TopicAliasMax != 0 && c.ProtocolLevel != 5 {
+		return errors.New("mqtt: topic alias requires protocol level 5")
+	}
 	if err := stringCheck(c.UserName); err != nil {
 		return fmt.Errorf("mqtt: illegal user name: %w", err)
 	}
 	if len(c.Password) > stringMax {
 		return fmt.Errorf("mqtt: password exceeds %d bytes", stringMax)
 	}
-	if len(c.Will.Message) > stringMax {
+	return c.Will.valid(c.ProtocolLevel)
+}
+
+// Will is a message which the broker publishes on behalf of the client, when
+// the connection terminates without Disconnect.
+type Will struct {
+	Topic   string // destination
+	Message []byte // payload
+
+	Retain      bool // see PublishRetained
+	AtLeastOnce bool // see PublishAtLeastOnce
+	ExactlyOnce bool // overrides AtLeastOnce
+
+	// The following options require ProtocolLevel 5.
+	DelayInterval uint32 // seconds before publication
+	MessageExpiry uint32 // lifetime in seconds, with zero for none
+	ContentType   string // MIME type of the message
+}
+
+func (w *Will) valid(protocolLevel byte) error {
+	if len(w.Message) > stringMax {
 		return fmt.Errorf("mqtt: will message exceeds %d bytes", stringMax)
 	}
+	if protocolLevel != 5 && (w.DelayInterval != 0 || w.MessageExpiry != 0 || w.ContentType != "") {
+		return errors.New("mqtt: will properties require protocol level 5")
+	}
+	if err := stringCheck(w.ContentType); err != nil {
+		return fmt.Errorf("mqtt: illegal will content type: %w", err)
+	}
 
 	var err error
-	if c.Will.Message != nil {
-		err = topicCheck(c.Will.Topic)
+	if w.Message != nil {
+		err = topicNameCheck(w.Topic)
 	} else {
-		err = stringCheck(c.Will.Topic)
+		err = stringCheck(w.Topic)
 	}
 	if err != nil {
 		return fmt.Errorf("mqtt: illegal will topic: %w", err)
 	}
-
 	return nil
 }
 
+// AppendProperties encodes the will properties [MQTT 5.0].
+func (w *Will) appendProperties(p []byte) []byte {
+	var size int
+	if w.DelayInterval != 0 {
+		size += 5
+	}
+	if w.MessageExpiry != 0 {
+		size += 5
+	}
+	if w.ContentType != "" {
+		size += 3 + len(w.ContentType)
+	}
+
+	p = appendVarint(p, size)
+	if w.DelayInterval != 0 {
+		p = append(p, propWillDelay,
+			byte(w.DelayInterval>>24), byte(w.DelayInterval>>16), byte(w.DelayInterval>>8), byte(w.DelayInterval))
+	}
+	if w.MessageExpiry != 0 {
+		p = append(p, propMessageExpiry,
+			byte(w.MessageExpiry>>24), byte(w.MessageExpiry>>16), byte(w.MessageExpiry>>8), byte(w.MessageExpiry))
+	}
+	if w.ContentType != "" {
+		p = append(p, propContentType, byte(len(w.ContentType)>>8), byte(len(w.ContentType)))
+		p = append(p, w.ContentType...)
+	}
+	return p
+}
+
 // NewCONNREQ returns a new packet.
 func (c *Config) newCONNREQ(clientID []byte) []byte {
 	size := 12 + len(clientID)
@@ -185,6 +393,27 @@ func (c *Config) newCONNREQ(clientID []byte) []byte {
 		flags |= 1 << 1
 	}
 
+	level := byte(4)
+	var props, willProps []byte
+	if c.ProtocolLevel == 5 {
+		level = 5
+		props = []byte{0}
+		if !c.CleanSession {
+			// “If the Session Expiry Interval is absent the value 0 is
+			// used.” — MQTT Version 5.0, subsection 3.1.2.11.2
+			props = append(props, propSessionExpiry, 0xff, 0xff, 0xff, 0xff)
+		}
+		if c.TopicAliasMax != 0 {
+			props = append(props, propTopicAliasMax, byte(c.TopicAliasMax>>8), byte(c.TopicAliasMax))
+		}
+		props[0] = byte(len(props) - 1)
+		size += len(props)
+		if c.Will.Message != nil {
+			willProps = c.Will.appendProperties(nil)
+			size += len(willProps)
+		}
+	}
+
 	// encode packet
 	packet := make([]byte, 0, size+2)
 	packet = append(packet, typeCONNECT<<4)
@@ -193,12 +422,14 @@ func (c *Config) newCONNREQ(clientID []byte) []byte {
 		packet = append(packet, byte(l|0x80))
 	}
 	packet = append(packet, byte(l),
-		0, 4, 'M', 'Q', 'T', 'T', 4, byte(flags),
+		0, 4, 'M', 'Q', 'T', 'T', level, byte(flags),
 		byte(c.KeepAlive>>8), byte(c.KeepAlive),
-		byte(len(clientID)>>8), byte(len(clientID)),
 	)
+	packet = append(packet, props...)
+	packet = append(packet, byte(len(clientID)>>8), byte(len(clientID)))
 	packet = append(packet, clientID...)
 	if c.Will.Message != nil {
+		packet = append(packet, willProps...)
 		packet = append(packet, byte(len(c.Will.Topic)>>8), byte(len(c.Will.Topic)))
 		packet = append(packet, c.Will.Topic...)
 		packet = append(packet, byte(len(c.Will.Message)>>8), byte(len(c.Will.Message)))
@@ -222,7 +453,8 @@ func (c *Config) newCONNREQ(clientID []byte) []byte {
 // goes for the automatic reconnects on connection loss.
 //
 // A single goroutine must invoke ReadSlices consecutively until ErrClosed. Some
-// backoff on error reception comes recommended though.
+// backoff on error reception comes recommended though, as automated with
+// Config.AutoReconnect.
 //
 // Multiple goroutines may invoke methods on a Client simultaneously, except for
 // ReadSlices.
@@ -234,11 +466,49 @@ type Client struct {
 	// Signal channels are closed once their respective state occurs.
 	// Each read must restore or replace the signleton value.
 	onlineSig, offlineSig chan chan struct{}
+	// The window signal is closed while publish submission has capacity.
+	windowSig chan chan struct{}
 
 	// The read routine controls the connection, including reconnects.
-	readConn net.Conn
-	r        *bufio.Reader // conn buffered
-	peek     []byte        // pending slice from bufio.Reader
+	readConn     net.Conn
+	r            *bufio.Reader // conn buffered
+	peek         []byte        // pending slice from bufio.Reader
+	connected    bool          // at least one connect succeeded
+	readDeadline time.Time     // ReadSlicesTimeout, if any
+	retainedDrop time.Time     // DropRetained ends, if any
+	publishHead  byte          // fixed header from the last PUBLISH read
+	publishID    uint          // packet identifier from the last PUBLISH read
+	// Queue entries on hold for the Receive Maximum from the broker, as
+	// the number of entries at the end of each respective queue, which
+	// were not resent on the current connection yet [MQTT 5.0].
+	atLeastOnceHeld, exactlyOnceHeld uint
+	// PUBLISH with an “exactly once” guarantee which failed on PUBREC,
+	// while PUBCOMP was pending for a predecessor, end in line [MQTT 5.0].
+	exactlyOnceFailed map[uint]error
+	// The delay before the next reconnect, if any [AutoReconnect].
+	reconnectDelay time.Duration
+	// Topic aliases from the broker apply per connection.
+	topicAliases map[uint16][]byte
+	// Topic aliases to the broker apply per connection too. Access
+	// requires the write lock [writeSem], like the connection.
+	aliasOutMax uint16
+	aliasOut    map[string]uint16
+
+	// Seconds in effect since the last connect. Atomic access only.
+	keepAlive uint32
+	// Shutdown denies publications when set. The count has submissions
+	// with an “at least once” or an “exactly once” guarantee, which got
+	// past the flag, yet not into their respective queue [submitPersisted].
+	shutdownMutex sync.Mutex
+	shuttingDown  bool
+	submitting    int
+	// Shutdown awaits a token on each drain in the publish queues.
+	drainSig chan struct{}
+	// Warm requests the read routine to connect without delay, with the
+	// outcome on the submitted channel.
+	warmReq chan chan<- error
+	// CONNACK flag from the last connect. Atomic access only.
+	sessionPresent uint32
 
 	// The semaphore locks connection control. A nil entry implies no
 	// successful connect yet.
@@ -262,6 +532,13 @@ type Client struct {
 
 	// The semaphore allows for one ping request at a time.
 	pingAck chan chan<- error
+	// The keep-alive has one PINGREQ pending at most. It precedes any ping
+	// request which registered in the mean time.
+	keepAlivePong chan chan struct{}
+	// The keep-alive signals connection reset to the read routine.
+	pongLost chan struct{}
+	// The last write to the connection is guarded by writeSem.
+	lastWrite time.Time
 
 	// The semaphores lock the respective acknowledge queues with a
 	// submission counter. Overflows are acceptable.
@@ -272,15 +549,125 @@ type Client struct {
 
 	// Outbout PUBLISH acknowledgement is traced by a callback channel.
 	atLeastOnceQ, exactlyOnceQ chan chan<- error
+	// The Receive Maximum from the broker limits both queues combined,
+	// with zero for none. Submissions in progress count as pending.
+	// Atomic access only.
+	receiveMax     uint32
+	receivePending int32
+	// The submission time of each callback channel is kept in order.
+	queueTimes
 
 	orderedTxs
 	unorderedTxs
+	// The topic filters in use are tracked for matching.
+	subs subscriptions
 
 	// The read routine sends its content on the next ReadSlices.
 	pendingAck []byte
+	// The read routine watches the pendingAck of a PUBREC, if any.
+	holdTimer *time.Timer
+	// The read routine tracks the packet identifiers of inbound PUBLISH
+	// with an “exactly once” guarantee which were dropped, until PUBREL.
+	droppedExactlyOnce map[uint]struct{}
+	// The read routine limits the connection lifetime, if configured.
+	sessionTimer *time.Timer
 
 	// The read routine parks reception beyond readBufSize.
 	bigMessage *BigMessage
+
+	// Warnings are issued only once.
+	volatileWarn sync.Once
+
+	// Counters are updated with atomic operations. The allocation
+	// guarantees 64-bit alignment on 32-bit platforms.
+	stats *Stats
+}
+
+// SessionPresent returns whether the broker had a session for the client
+// identifier on the last connect, as reported by CONNACK. False means either
+// no connect yet, or a fresh session, which has no subscriptions.
+func (c *Client) SessionPresent() bool {
+	return atomic.LoadUint32(&c.sessionPresent) != 0
+}
+
+// EffectiveKeepAlive returns the keep-alive in force since the last connect.
+// Zero means either no connect yet, or keep-alive disabled.
+func (c *Client) EffectiveKeepAlive() time.Duration {
+	return time.Duration(atomic.LoadUint32(&c.keepAlive)) * time.Second
+}
+
+// Stats holds Client metrics. Counters accumulate since construction.
+type Stats struct {
+	// SubscribeDowngrades counts the topic filters which the broker
+	// granted with a lower quality-of-service level than requested.
+	SubscribeDowngrades uint64
+
+	// ReceiveN counts the messages from ReadSlices, including BigMessage,
+	// and ReceiveBytes sums their size.
+	ReceiveN, ReceiveBytes uint64
+	// PublishN counts the messages accepted by any of the publish methods,
+	// i.e., without error return, and PublishBytes sums their size.
+	PublishN, PublishBytes uint64
+
+	// PacketSizes counts the inbound packets, except for CONNACK, per
+	// remaining length, in buckets of up to 16 B, 64 B, 256 B, 1 KiB,
+	// 4 KiB, 16 KiB, 64 KiB, and beyond respectively.
+	PacketSizes [8]uint64
+
+	// OutboundQueueLen has the number of PublishAtLeastOnce plus the
+	// number of PublishExactlyOnce requests pending confirmation.
+	OutboundQueueLen int
+	// OldestQueuedAge has the time passed since the submission of the
+	// oldest request in the outbound queue, if any.
+	OldestQueuedAge time.Duration
+}
+
+// Stats returns a snapshot of the metrics.
+func (c *Client) Stats() Stats {
+	s := Stats{
+		SubscribeDowngrades: atomic.LoadUint64(&c.stats.SubscribeDowngrades),
+		ReceiveN:            atomic.LoadUint64(&c.stats.ReceiveN),
+		ReceiveBytes:        atomic.LoadUint64(&c.stats.ReceiveBytes),
+		PublishN:            atomic.LoadUint64(&c.stats.PublishN),
+		PublishBytes:        atomic.LoadUint64(&c.stats.PublishBytes),
+	}
+	for i := range s.PacketSizes {
+		s.PacketSizes[i] = atomic.LoadUint64(&c.stats.PacketSizes[i])
+	}
+	s.OutboundQueueLen, s.OldestQueuedAge = c.queueTimes.backlog()
+	return s
+}
+
+// ResetStats zeroes the counters in Stats, e.g., to sample in windows. The
+// counters keep updating concurrently. A Stats followed by a ResetStats may
+// miss updates which happened in between.
+func (c *Client) ResetStats() {
+	atomic.StoreUint64(&c.stats.SubscribeDowngrades, 0)
+	atomic.StoreUint64(&c.stats.ReceiveN, 0)
+	atomic.StoreUint64(&c.stats.ReceiveBytes, 0)
+	atomic.StoreUint64(&c.stats.PublishN, 0)
+	atomic.StoreUint64(&c.stats.PublishBytes, 0)
+	for i := range c.stats.PacketSizes {
+		atomic.StoreUint64(&c.stats.PacketSizes[i], 0)
+	}
+}
+
+func (c *Client) countReceive(size int) {
+	atomic.AddUint64(&c.stats.ReceiveN, 1)
+	atomic.AddUint64(&c.stats.ReceiveBytes, uint64(size))
+}
+
+func (c *Client) countPacketSize(size int) {
+	var i int
+	for limit := 16; size > limit && i < len(c.stats.PacketSizes)-1; limit <<= 2 {
+		i++
+	}
+	atomic.AddUint64(&c.stats.PacketSizes[i], 1)
+}
+
+func (c *Client) countPublish(size int) {
+	atomic.AddUint64(&c.stats.PublishN, 1)
+	atomic.AddUint64(&c.stats.PublishBytes, uint64(size))
 }
 
 func newClient(p Persistence, config *Config) *Client {
@@ -297,10 +684,15 @@ func newClient(p Persistence, config *Config) *Client {
 		persistence:      p,
 		onlineSig:        make(chan chan struct{}, 1),
 		offlineSig:       make(chan chan struct{}, 1),
+		windowSig:        make(chan chan struct{}, 1),
 		connSem:          make(chan net.Conn, 1),
 		writeSem:         make(chan net.Conn, 1),
 		writeBlock:       make(chan struct{}, 1),
 		pingAck:          make(chan chan<- error, 1),
+		keepAlivePong:    make(chan chan struct{}, 1),
+		pongLost:         make(chan struct{}, 1),
+		drainSig:         make(chan struct{}, 1),
+		warmReq:          make(chan chan<- error),
 		atLeastOnceSem:   make(chan uint, 1),
 		exactlyOnceSem:   make(chan uint, 1),
 		atLeastOnceBlock: make(chan holdup, 1),
@@ -309,7 +701,22 @@ func newClient(p Persistence, config *Config) *Client {
 		exactlyOnceQ:     make(chan chan<- error, config.ExactlyOnceMax),
 		unorderedTxs: unorderedTxs{
 			perPacketID: make(map[uint16]unorderedCallback),
+			onReserve:   config.OnReserve,
+			onFree:      config.OnFree,
 		},
+		stats: new(Stats),
+	}
+	switch {
+	case c.ReadPauseTimeout == 0:
+		c.ReadPauseTimeout = c.PauseTimeout
+	case c.ReadPauseTimeout < 0:
+		c.ReadPauseTimeout = 0
+	}
+	switch {
+	case c.WritePauseTimeout == 0:
+		c.WritePauseTimeout = c.PauseTimeout
+	case c.WritePauseTimeout < 0:
+		c.WritePauseTimeout = 0
 	}
 
 	// start in offline state
@@ -317,6 +724,7 @@ func newClient(p Persistence, config *Config) *Client {
 	released := make(chan struct{})
 	close(released)
 	c.offlineSig <- released
+	c.windowSig <- released
 
 	c.connSem <- nil
 	c.dialCtx, c.dialCancel = context.WithCancel(context.Background())
@@ -326,6 +734,13 @@ func newClient(p Persistence, config *Config) *Client {
 	return c
 }
 
+// Warn passes err to Config.Warn, if any.
+func (c *Client) warn(err error) {
+	if c.Warn != nil {
+		c.Warn(err)
+	}
+}
+
 // TermConn hijacks connection access. Further connect, write and writeBuffers
 // requests are denied with ErrClosed, regardless of the error return.
 func (c *Client) termConn(quit <-chan struct{}) (net.Conn, error) {
@@ -362,12 +777,47 @@ func (c *Client) termConn(quit <-chan struct{}) (net.Conn, error) {
 	}
 }
 
+// SetWill replaces the Will from Config for any following connect attempts.
+// A nil Will disables the option. Updates are denied while the Client is
+// online, as the broker received the Will with the connect request already.
+func (c *Client) SetWill(w *Will) error {
+	var will Will
+	if w != nil {
+		will = *w // copy
+	}
+	if err := will.valid(c.ProtocolLevel); err != nil {
+		return err
+	}
+
+	conn, ok := <-c.connSem // locks connection control
+	if !ok {
+		return fmt.Errorf("%w; will not set", ErrClosed)
+	}
+	defer func() {
+		c.connSem <- conn // unlock
+	}()
+
+	select {
+	case <-c.Online():
+		return errors.New("mqtt: will update denied while online")
+	default:
+		c.Will = will
+		return nil
+	}
+}
+
 // Close terminates the connection establishment.
 // The Client is closed regardless of the error return.
 // Closing an already closed Client has no effect.
+// See Config.CloseGrace for packet submission in progress.
 func (c *Client) Close() error {
 	quit := make(chan struct{})
-	close(quit) // no waiting
+	if c.CloseGrace > 0 {
+		timer := time.AfterFunc(c.CloseGrace, func() { close(quit) })
+		defer timer.Stop()
+	} else {
+		close(quit) // no waiting
+	}
 	conn, err := c.termConn(quit)
 	switch err {
 	case nil:
@@ -399,7 +849,10 @@ func (c *Client) Disconnect(quit <-chan struct{}) error {
 	// “After sending a DISCONNECT Packet the Client MUST NOT send
 	// any more Control Packets on that Network Connection.”
 	// — MQTT Version 3.1.1, conformance statement MQTT-3.14.4-2
-	writeErr := write(conn, packetDISCONNECT, c.PauseTimeout)
+	writeErr := write(conn, packetDISCONNECT, c.WritePauseTimeout)
+	if writeErr == nil {
+		c.metricsWrite(packetDISCONNECT)
+	}
 	closeErr := conn.Close()
 	if writeErr != nil {
 		return writeErr
@@ -407,6 +860,44 @@ func (c *Client) Disconnect(quit <-chan struct{}) error {
 	return closeErr
 }
 
+// Shutdown is like Disconnect, but it awaits confirmation of each pending
+// PublishAtLeastOnce and PublishExactlyOnce first. New publications receive
+// ErrClosed from the start. The read routine must keep running for the
+// confirmations to arrive. The Client is closed regardless of the error return.
+//
+// Quit is optional, as nil just blocks. Appliance of quit closes the Client
+// without DISCONNECT, and it will strictly result in ErrCanceled.
+func (c *Client) Shutdown(quit <-chan struct{}) error {
+	c.shutdownMutex.Lock()
+	c.shuttingDown = true
+	c.shutdownMutex.Unlock()
+
+	for {
+		c.shutdownMutex.Lock()
+		pending := c.submitting + len(c.atLeastOnceQ) + len(c.exactlyOnceQ)
+		c.shutdownMutex.Unlock()
+		if pending == 0 {
+			break
+		}
+
+		select {
+		case <-c.drainSig:
+			continue
+		case <-c.dialCtx.Done():
+			return fmt.Errorf("%w; PUBLISH not confirmed on shutdown", ErrClosed)
+		case <-quit:
+			c.Close()
+			return fmt.Errorf("%w; PUBLISH not confirmed on shutdown", ErrCanceled)
+		}
+	}
+
+	err := c.Disconnect(quit)
+	if errors.Is(err, ErrCanceled) {
+		c.Close()
+	}
+	return err
+}
+
 func (c *Client) termCallbacks() {
 	var wg sync.WaitGroup
 
@@ -425,6 +916,7 @@ func (c *Client) termCallbacks() {
 
 		// flush queue
 		err := fmt.Errorf("%w; PUBLISH not confirmed", ErrClosed)
+		c.queueTimes.clear(&c.queueTimes.atLeastOnce)
 		close(c.atLeastOnceQ)
 		for ch := range c.atLeastOnceQ {
 			select {
@@ -449,6 +941,7 @@ func (c *Client) termCallbacks() {
 
 		// flush queue
 		err := fmt.Errorf("%w; PUBLISH not confirmed", ErrClosed)
+		c.queueTimes.clear(&c.queueTimes.exactlyOnce)
 		close(c.exactlyOnceQ)
 		for ch := range c.exactlyOnceQ {
 			select {
@@ -467,6 +960,7 @@ func (c *Client) termCallbacks() {
 		break
 	}
 	wg.Wait()
+	c.windowFree() // wake up for ErrClosed
 
 	c.unorderedTxs.breakAll()
 }
@@ -485,6 +979,114 @@ func (c *Client) Offline() <-chan struct{} {
 	return ch
 }
 
+// WindowAvailable returns a channel that's closed when PublishAtLeastOnce and
+// PublishExactlyOnce may have capacity again, i.e., no ErrMax. The channel is
+// replaced on each ErrMax. Note that the signal applies to both quality-of-
+// service levels, so another ErrMax remains possible.
+func (c *Client) WindowAvailable() <-chan struct{} {
+	ch := <-c.windowSig
+	c.windowSig <- ch
+	return ch
+}
+
+// InFlight returns the number of PublishAtLeastOnce plus PublishExactlyOnce
+// pending confirmation, and the limit thereof. The limit is AtLeastOnceMax plus
+// ExactlyOnceMax, or the Receive Maximum from the broker when less [MQTT 5.0].
+// Note that each level has its own limit, so ErrMax may happen even when the
+// total is below the limit.
+func (c *Client) InFlight() (inUse, limit int) {
+	inUse = len(c.atLeastOnceQ) + len(c.exactlyOnceQ)
+	limit = cap(c.atLeastOnceQ) + cap(c.exactlyOnceQ)
+	if max := int(atomic.LoadUint32(&c.receiveMax)); max != 0 && max < limit {
+		limit = max
+	}
+	return inUse, limit
+}
+
+// WindowFull resets the window signal on ErrMax from q.
+func (c *Client) windowFull(q chan chan<- error) {
+	ch := <-c.windowSig
+	select {
+	case <-ch:
+		ch = make(chan struct{})
+	default:
+		break // pending already
+	}
+	if len(q) < cap(q) && c.receiveRoom() {
+		close(ch) // released in the mean time
+	}
+	c.windowSig <- ch
+}
+
+// PublishDenied returns whether Shutdown was called.
+func (c *Client) publishDenied() bool {
+	c.shutdownMutex.Lock()
+	defer c.shutdownMutex.Unlock()
+	return c.shuttingDown
+}
+
+// DrainNotify wakes up Shutdown, if any.
+func (c *Client) drainNotify() {
+	select {
+	case c.drainSig <- struct{}{}:
+	default: // pending already
+	}
+}
+
+// WindowFree releases the window signal, if pending.
+func (c *Client) windowFree() {
+	ch := <-c.windowSig
+	select {
+	case <-ch:
+		break // released already
+	default:
+		close(ch)
+	}
+	c.windowSig <- ch
+}
+
+// Warm gets the Client online, such that the first request won't pay for the
+// handshake latency. A connect attempt which waits on a delay, either from
+// Config.AutoReconnect or from Config.ConnectRetry, starts right away. Connects
+// are executed by ReadSlices, so the read routine must run in order for Warm to
+// return. The error from a failed connect attempt is passed as is.
+//
+// The Client sends a PINGREQ once the KeepAlive period passes without any
+// other traffic, such that the broker won't drop the connection.
+//
+// Quit is optional, as nil just blocks. Appliance of quit will strictly result
+// in ErrCanceled.
+func (c *Client) Warm(quit <-chan struct{}) error {
+	result := make(chan error, 1)
+	select {
+	case <-c.Online():
+		return nil
+	case c.warmReq <- result:
+		break // read routine connects now
+	case <-c.dialCtx.Done():
+		return ErrClosed
+	case <-quit:
+		return ErrCanceled
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-quit:
+		return ErrCanceled
+	}
+}
+
+// AcceptWarm returns the result channel of a pending Warm, if any.
+func (c *Client) acceptWarm() chan<- error {
+	select {
+	case result := <-c.warmReq:
+		return result
+	default:
+		return nil
+	}
+}
+
 func (c *Client) toOnline() {
 	on := <-c.onlineSig
 	select {
@@ -541,7 +1143,40 @@ func (c *Client) toOffline() {
 	default:
 		break
 	}
+	select {
+	case pong := <-c.keepAlivePong:
+		close(pong) // check stops on the connection change
+	default:
+		break
+	}
 	c.unorderedTxs.breakAll()
+	if c.dialCtx.Err() == nil { // not closed
+		downExchanges(c.atLeastOnceSem, c.atLeastOnceBlock, c.atLeastOnceQ)
+		downExchanges(c.exactlyOnceSem, c.exactlyOnceBlock, c.exactlyOnceQ)
+	}
+}
+
+// DownExchanges submits ErrDown to each entry in q, with room left for an
+// ErrClosed. The exchanges resume on the next connect.
+func downExchanges(sem chan uint, block chan holdup, q chan chan<- error) {
+	select { // locks publish submission
+	case counter, ok := <-sem:
+		if !ok {
+			return // ErrClosed submitted already
+		}
+		defer func() { sem <- counter }()
+	case holdup := <-block:
+		defer func() { block <- holdup }()
+	}
+
+	err := fmt.Errorf("%w; PUBLISH not confirmed yet", ErrDown)
+	for n := len(q); n > 0; n-- {
+		ch := <-q
+		if len(ch) < cap(ch)-1 {
+			ch <- err
+		}
+		q <- ch // keeps order
+	}
 }
 
 func (c *Client) lockWrite(quit <-chan struct{}) (net.Conn, error) {
@@ -560,6 +1195,112 @@ func (c *Client) lockWrite(quit <-chan struct{}) (net.Conn, error) {
 	}
 }
 
+// ExpireSession terminates conn gracefully, if it is still in use. The read
+// routine reconnects on the interrupt.
+func (c *Client) expireSession(conn net.Conn) {
+	current, err := c.lockWrite(c.Offline())
+	if err != nil {
+		return // connection lost already
+	}
+	if current != conn {
+		c.writeSem <- current // unlocks writes
+		return
+	}
+
+	// DISCONNECT discards the Will
+	if write(conn, packetDISCONNECT, c.WritePauseTimeout) == nil {
+		c.metricsWrite(packetDISCONNECT)
+	}
+	conn.Close()               // interrupts read routine
+	c.writeBlock <- struct{}{} // parks writes
+}
+
+// KeepAliveCheck sends a PINGREQ once conn had no writes for d. The check
+// reschedules itself for as long as conn is in use.
+func (c *Client) keepAliveCheck(conn net.Conn, d time.Duration) {
+	current, err := c.lockWrite(c.Offline())
+	if err != nil {
+		return // connection lost already
+	}
+	if current != conn {
+		c.writeSem <- current // unlocks writes
+		return
+	}
+	if idle := time.Since(c.lastWrite); idle < d {
+		c.writeSem <- conn // unlocks writes
+		time.AfterFunc(d-idle, func() { c.keepAliveCheck(conn, d) })
+		return
+	}
+
+	if len(c.pingAck) != 0 {
+		// A pending Ping has its PINGREQ on the way. The write
+		// lock makes it follow the check, if not submitted yet.
+		c.writeSem <- conn // unlocks writes
+		time.AfterFunc(d, func() { c.keepAliveCheck(conn, d) })
+		return
+	}
+	pong := make(chan struct{})
+	c.keepAlivePong <- pong // won't block; one check at a time
+	if err := write(conn, packetPINGREQ, c.WritePauseTimeout); err != nil {
+		conn.Close()               // interrupts read routine
+		c.writeBlock <- struct{}{} // parks writes
+		return
+	}
+	c.lastWrite = time.Now()
+	c.metricsWrite(packetPINGREQ)
+	c.writeSem <- conn // unlocks writes
+
+	timer := time.NewTimer(d)
+	select {
+	case <-pong:
+		timer.Stop()
+	case <-timer.C:
+		select {
+		case <-pong:
+			break // just in time
+		default:
+			select {
+			case p := <-c.keepAlivePong:
+				if p == pong {
+					c.resetPongLost(conn)
+					return
+				}
+				c.keepAlivePong <- p // not ours
+			default:
+				break // picked up in mean time
+			}
+			<-pong
+		}
+	}
+	time.AfterFunc(d, func() { c.keepAliveCheck(conn, d) })
+}
+
+// ResetPongLost terminates conn, if it is still in use. The read routine
+// reports errPongLost on the interrupt.
+func (c *Client) resetPongLost(conn net.Conn) {
+	current, err := c.lockWrite(c.Offline())
+	if err != nil {
+		return // connection lost already
+	}
+	if current != conn {
+		c.writeSem <- current // unlocks writes
+		return
+	}
+
+	select {
+	case c.pongLost <- struct{}{}:
+	default:
+	}
+	conn.Close()               // interrupts read routine
+	c.writeBlock <- struct{}{} // parks writes
+}
+
+func (c *Client) metricsWrite(packet []byte) {
+	if c.Metrics != nil {
+		c.Metrics.OnPacketWrite(packet[0]>>4, len(packet))
+	}
+}
+
 // Write submits the packet. Keep synchronised with writeBuffers!
 func (c *Client) write(quit <-chan struct{}, p []byte) error {
 	for {
@@ -568,8 +1309,10 @@ func (c *Client) write(quit <-chan struct{}, p []byte) error {
 			return err
 		}
 
-		switch err := write(conn, p, c.PauseTimeout); {
+		switch err := write(conn, p, c.WritePauseTimeout); {
 		case err == nil:
+			c.lastWrite = time.Now()
+			c.metricsWrite(p)
 			c.writeSem <- conn // unlocks writes
 			return nil
 
@@ -587,14 +1330,38 @@ func (c *Client) write(quit <-chan struct{}, p []byte) error {
 
 // WriteBuffers submits the packet. Keep synchronised with write!
 func (c *Client) writeBuffers(quit <-chan struct{}, p net.Buffers) error {
+	head := p[0][0]
+	kind := head >> 4
+	// PUBLISH “at least once” and “exactly once” are checked on submission
+	if kind == typePUBLISH && head&0b110 == 0 && c.publishDenied() {
+		return fmt.Errorf("%w; PUBLISH denied on shutdown", ErrClosed)
+	}
 	for {
 		conn, err := c.lockWrite(quit)
 		if err != nil {
 			return err
 		}
 
-		switch err := writeBuffers(conn, p, c.PauseTimeout); {
+		// Write a copy, as writes consume their buffers, and interrupts
+		// retry. Topic aliases apply to PUBLISH “at most once” only, as
+		// any other persists beyond the connection.
+		var q net.Buffers
+		if c.aliasOutMax != 0 && kind == typePUBLISH && head&0b110 == 0 {
+			q = c.applyTopicAlias(p)
+		} else {
+			q = append(make(net.Buffers, 0, len(p)), p...)
+		}
+		var size int
+		for _, b := range q {
+			size += len(b)
+		}
+
+		switch err := writeBuffers(conn, q, c.WritePauseTimeout); {
 		case err == nil:
+			c.lastWrite = time.Now()
+			if c.Metrics != nil {
+				c.Metrics.OnPacketWrite(kind, size)
+			}
 			c.writeSem <- conn // unlocks writes
 			return nil
 
@@ -610,6 +1377,41 @@ func (c *Client) writeBuffers(quit <-chan struct{}, p net.Buffers) error {
 	}
 }
 
+// ApplyTopicAlias returns the PUBLISH composition from appendPublishPacket with
+// a topic alias, if available. The first use of an alias carries the topic, and
+// any following PUBLISH has an empty topic instead [MQTT 5.0]. The write lock
+// must be held.
+func (c *Client) applyTopicAlias(p net.Buffers) net.Buffers {
+	header, props, message := p[0], p[1], p[2]
+	_, n := readVarint(header[1:])
+	topic := header[1+n+2:]
+
+	alias, ok := c.aliasOut[string(topic)]
+	if !ok {
+		if len(c.aliasOut) >= int(c.aliasOutMax) {
+			return p // all in use
+		}
+		if c.aliasOut == nil {
+			c.aliasOut = make(map[string]uint16)
+		}
+		alias = uint16(len(c.aliasOut) + 1)
+		c.aliasOut[string(topic)] = alias
+	} else {
+		topic = nil
+	}
+
+	propsSize, n := readVarint(props)
+	aliasProps := appendVarint(make([]byte, 0, 4+3+propsSize), propsSize+3)
+	aliasProps = append(aliasProps, propTopicAlias, byte(alias>>8), byte(alias))
+	aliasProps = append(aliasProps, props[n:]...)
+
+	size := 2 + len(topic) + len(aliasProps) + len(message)
+	aliasHeader := appendVarint(append(make([]byte, 0, 7+len(topic)), header[0]), size)
+	aliasHeader = append(aliasHeader, byte(len(topic)>>8), byte(len(topic)))
+	aliasHeader = append(aliasHeader, topic...)
+	return net.Buffers{aliasHeader, aliasProps, message}
+}
+
 // Write submits the packet. Keep synchronised with writeBuffers!
 func write(conn net.Conn, p []byte, idleTimeout time.Duration) error {
 	if idleTimeout != 0 {
@@ -681,25 +1483,42 @@ func writeBuffers(conn net.Conn, p net.Buffers, idleTimeout time.Duration) error
 
 // PeekPacket slices a packet payload from the read buffer into c.peek.
 func (c *Client) peekPacket() (head byte, err error) {
+	if !c.readDeadline.IsZero() && c.r.Buffered() == 0 {
+		err := c.readConn.SetReadDeadline(c.readDeadline)
+		if err != nil {
+			return 0, err // deemed critical
+		}
+		defer c.readConn.SetReadDeadline(time.Time{})
+	}
 	head, err = c.r.ReadByte()
 	if err != nil {
-		if errors.Is(err, io.EOF) {
+		switch {
+		case errors.Is(err, io.EOF):
 			err = errBrokerTerm
+		case !c.readDeadline.IsZero() && errors.Is(err, os.ErrDeadlineExceeded):
+			err = ErrReadTimeout
 		}
 		return 0, err
 	}
+	if !c.readDeadline.IsZero() && c.ReadPauseTimeout == 0 {
+		// clear before the remainder of the packet
+		err := c.readConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return 0, err // deemed critical
+		}
+	}
 
-	if c.PauseTimeout != 0 {
+	if c.ReadPauseTimeout != 0 {
 		// Abandon timer to prevent waking up the system for no good reason.
 		// https://developer.apple.com/library/archive/documentation/Performance/Conceptual/EnergyGuide-iOS/MinimizeTimerUse.html
 		defer c.readConn.SetReadDeadline(time.Time{})
 	}
 
 	// decode “remaining length”
-	var size int
-	for shift := uint(0); ; shift += 7 {
-		if c.r.Buffered() == 0 && c.PauseTimeout != 0 {
-			err := c.readConn.SetReadDeadline(time.Now().Add(c.PauseTimeout))
+	var size, shift int
+	for ; ; shift += 7 {
+		if c.r.Buffered() == 0 && c.ReadPauseTimeout != 0 {
+			err := c.readConn.SetReadDeadline(time.Now().Add(c.ReadPauseTimeout))
 			if err != nil {
 				return 0, err // deemed critical
 			}
@@ -716,14 +1535,19 @@ func (c *Client) peekPacket() (head byte, err error) {
 			break
 		}
 		if shift > 21 {
-			return 0, fmt.Errorf("%w: remaining length encoding from packet %#b exceeds 4 bytes", errProtoReset, head)
+			return 0, fmt.Errorf("%w: remaining length encoding from packet %#b exceeds 4 bytes", ErrProtocol, head)
 		}
 	}
 
+	c.countPacketSize(size)
+	if c.Metrics != nil {
+		c.Metrics.OnPacketRead(head>>4, 2+shift/7+size)
+	}
+
 	// slice payload form read buffer
 	for {
-		if c.r.Buffered() < size {
-			err := c.readConn.SetReadDeadline(time.Now().Add(c.PauseTimeout))
+		if c.r.Buffered() < size && c.ReadPauseTimeout != 0 {
+			err := c.readConn.SetReadDeadline(time.Now().Add(c.ReadPauseTimeout))
 			if err != nil {
 				return 0, err // deemed critical
 			}
@@ -758,7 +1582,6 @@ func (c *Client) connect() error {
 	if err != nil {
 		return err
 	}
-	packet := c.newCONNREQ(clientID)
 
 	<-c.Offline() // extra verification
 
@@ -792,6 +1615,7 @@ func (c *Client) connect() error {
 	if oldConn != nil && c.CleanSession {
 		c.CleanSession = false
 	}
+	packet := c.newCONNREQ(clientID)
 	ctx, cancel := context.WithTimeout(c.dialCtx, c.PauseTimeout)
 	defer cancel()
 	conn, err := c.Dialer(ctx)
@@ -813,7 +1637,7 @@ func (c *Client) connect() error {
 
 		// FIXME(pascaldekloe): Error string matching is supported
 		// according to <https://github.com/golang/go/issues/36208>.
-		if strings.Contains(err.Error(), "operation was canceled") {
+		if strings.Contains(err.Error(), "operation was canceled") || errors.Is(err, context.Canceled) {
 			return ErrClosed
 		}
 		return err
@@ -825,7 +1649,7 @@ func (c *Client) connect() error {
 
 	c.connSem <- conn // release early for interruption by Close
 
-	r, err := c.handshake(conn, packet)
+	r, keepAlive, sessionPresent, err := c.handshake(conn, packet)
 	if err != nil {
 		conn.Close()      // abandon
 		c.writeSem <- nil // causes ErrDown
@@ -848,32 +1672,85 @@ func (c *Client) connect() error {
 		return err
 	}
 
+	atomic.StoreUint32(&c.keepAlive, uint32(keepAlive))
+	if sessionPresent {
+		atomic.StoreUint32(&c.sessionPresent, 1)
+	} else {
+		atomic.StoreUint32(&c.sessionPresent, 0)
+	}
+	if c.sessionTimer != nil {
+		c.sessionTimer.Stop()
+	}
+	if c.MaxSessionDuration != 0 {
+		c.sessionTimer = time.AfterFunc(c.MaxSessionDuration, func() {
+			c.expireSession(conn)
+		})
+	}
+	if keepAlive != 0 {
+		d := time.Duration(keepAlive) * time.Second
+		time.AfterFunc(d, func() { c.keepAliveCheck(conn, d) })
+	}
+	select {
+	case <-c.pongLost: // from previous connection
+	default:
+	}
+	c.lastWrite = time.Now()
+
+	for alias := range c.topicAliases {
+		delete(c.topicAliases, alias)
+	}
+	for topic := range c.aliasOut {
+		delete(c.aliasOut, topic)
+	}
+
 	c.toOnline()
 	// install connection
 	c.writeSem <- conn
 	c.readConn = conn
+	c.connected = true
 	c.r = r
 	c.peek = nil // applied to prevous r if any
 
+	if !c.NoResubscribe && !sessionPresent {
+		topicFilters, options := c.subs.list()
+		if len(topicFilters) != 0 {
+			go c.resubscribe(topicFilters, options)
+		}
+	}
+
 	// Resend any pending PUBLISH and/or PUBREL entries from Persistence.
 	// The queues are locked because this runs within the read-routine and new
 	// submission requires either the sequence number semaphore or a holdup block.
+	// Entries beyond the Receive Maximum from the broker, if any, are held for
+	// resendHeld.
+	quota := ^uint(0)
+	if max := atomic.LoadUint32(&c.receiveMax); max != 0 {
+		quota = uint(max)
+	}
+	c.atLeastOnceHeld, c.exactlyOnceHeld = 0, 0
 	if n := uint(len(c.atLeastOnceQ)); n != 0 {
-		err := c.resendPublishPackets(atLeastOnceSeqNo-n, atLeastOnceSeqNo-1, atLeastOnceIDSpace)
+		if n > quota {
+			c.atLeastOnceHeld = n - quota
+		}
+		quota -= n - c.atLeastOnceHeld
+		err := c.resendPublishPackets(atLeastOnceSeqNo-n, n-c.atLeastOnceHeld, atLeastOnceIDSpace)
 		if err != nil {
-			c.toOffline()
 			c.atLeastOnceBlock <- holdup{atLeastOnceSeqNo - n, atLeastOnceSeqNo - 1}
 			n = uint(len(c.exactlyOnceQ))
 			c.exactlyOnceBlock <- holdup{exactlyOnceSeqNo - n, exactlyOnceSeqNo - 1}
+			c.toOffline() // needs the publish submission unlocked
 			return err
 		}
 	}
 	c.atLeastOnceSem <- atLeastOnceSeqNo
 	if n := uint(len(c.exactlyOnceQ)); n != 0 {
-		err := c.resendPublishPackets(exactlyOnceSeqNo-n, exactlyOnceSeqNo-1, exactlyOnceIDSpace)
+		if n > quota {
+			c.exactlyOnceHeld = n - quota
+		}
+		err := c.resendPublishPackets(exactlyOnceSeqNo-n, n-c.exactlyOnceHeld, exactlyOnceIDSpace)
 		if err != nil {
-			c.toOffline()
 			c.exactlyOnceBlock <- holdup{exactlyOnceSeqNo - n, exactlyOnceSeqNo - 1}
+			c.toOffline() // needs the publish submission unlocked
 			return err
 		}
 	}
@@ -882,9 +1759,105 @@ func (c *Client) connect() error {
 	return nil
 }
 
-func (c *Client) resendPublishPackets(firstSeqNo, lastSeqNo uint, space uint) error {
-	for seqNo := firstSeqNo; seqNo <= lastSeqNo; seqNo++ {
+// Reconnect applies Config.AutoReconnect on connect.
+func (c *Client) reconnect() error {
+	var warm chan<- error
+	if c.AutoReconnect && c.reconnectDelay > 0 {
+		timer := time.NewTimer(c.reconnectDelay)
+		select {
+		case <-c.dialCtx.Done():
+			timer.Stop()
+			return ErrClosed
+		case <-timer.C:
+			break
+		case warm = <-c.warmReq:
+			timer.Stop()
+		}
+	}
+	if warm == nil {
+		warm = c.acceptWarm()
+	}
+
+	err := c.connect()
+	if warm != nil {
+		warm <- err
+	}
+	switch {
+	case err == nil:
+		c.reconnectDelay = 0
+	case c.reconnectDelay <= 0:
+		c.reconnectDelay = c.RetryDelay
+		if c.reconnectDelay <= 0 {
+			c.reconnectDelay = 100 * time.Millisecond
+		}
+	default:
+		c.reconnectDelay *= 2
+		max := c.RetryDelayMax
+		if max <= 0 {
+			max = 30 * time.Second
+		}
+		if c.reconnectDelay > max {
+			c.reconnectDelay = max
+		}
+	}
+	return err
+}
+
+// ConnectRetry applies Config.ConnectRetry on connect.
+func (c *Client) connectRetry() error {
+	warm := c.acceptWarm()
+	err := c.connect()
+	if warm != nil {
+		warm <- err
+	}
+	if err == nil || c.ConnectRetry <= 0 {
+		return err
+	}
+
+	deadline := time.Now().Add(c.ConnectRetry)
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	for {
+		switch {
+		case errors.Is(err, ErrClosed):
+			return err
+		case IsConnectionRefused(err) && !errors.Is(err, ErrUnavailable):
+			return err // permanent
+		case time.Now().Add(delay).After(deadline):
+			return err // expired
+		}
+
+		warm = nil
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.dialCtx.Done():
+			timer.Stop()
+			return ErrClosed
+		case <-timer.C:
+			warm = c.acceptWarm()
+		case warm = <-c.warmReq:
+			timer.Stop()
+		}
+		delay *= 2
+
+		err = c.connect()
+		if warm != nil {
+			warm <- err
+		}
+		if err == nil {
+			return nil
+		}
+	}
+}
+
+func (c *Client) resendPublishPackets(firstSeqNo, n uint, space uint) error {
+	for seqNo := firstSeqNo; seqNo != firstSeqNo+n; seqNo++ {
 		key := seqNo&publishIDMask | space
+		if _, ok := c.exactlyOnceFailed[key]; ok {
+			continue // ends in line
+		}
 		packet, err := c.persistence.Load(key)
 		if err != nil {
 			return err
@@ -903,23 +1876,56 @@ func (c *Client) resendPublishPackets(firstSeqNo, lastSeqNo uint, space uint) er
 	return nil
 }
 
-func (c *Client) handshake(conn net.Conn, requestPacket []byte) (*bufio.Reader, error) {
-	err := write(conn, requestPacket, c.PauseTimeout)
+// ResendHeld retransmits the next queue entry on hold for the Receive Maximum
+// from the broker, if any. Invocation must follow the release of a queue entry
+// from within the read routine [MQTT 5.0].
+func (c *Client) resendHeld() error {
+	switch {
+	case c.atLeastOnceHeld != 0:
+		seqNo := c.orderedTxs.Acked + uint(len(c.atLeastOnceQ)) - c.atLeastOnceHeld
+		c.atLeastOnceHeld--
+		return c.resendPublishPackets(seqNo, 1, atLeastOnceIDSpace)
+	case c.exactlyOnceHeld != 0:
+		seqNo := c.orderedTxs.Completed + uint(len(c.exactlyOnceQ)) - c.exactlyOnceHeld
+		c.exactlyOnceHeld--
+		return c.resendPublishPackets(seqNo, 1, exactlyOnceIDSpace)
+	}
+	return nil
+}
+
+// Handshake returns the read buffer, the keep-alive in effect, and the session
+// present flag from CONNACK.
+func (c *Client) handshake(conn net.Conn, requestPacket []byte) (r *bufio.Reader, keepAlive uint16, sessionPresent bool, err error) {
+	err = write(conn, requestPacket, c.WritePauseTimeout)
 	if err != nil {
-		return nil, err
+		return nil, 0, false, err
 	}
+	c.metricsWrite(requestPacket)
 
-	r := bufio.NewReaderSize(conn, readBufSize)
+	r = bufio.NewReaderSize(conn, readBufSize)
 
 	// Apply the deadline to the "entire" 4-byte response.
-	if c.PauseTimeout != 0 {
-		err := conn.SetReadDeadline(time.Now().Add(c.PauseTimeout))
+	if c.ReadPauseTimeout != 0 {
+		err := conn.SetReadDeadline(time.Now().Add(c.ReadPauseTimeout))
 		if err != nil {
-			return nil, err // deemed critical
+			return nil, 0, false, err // deemed critical
 		}
 		defer conn.SetReadDeadline(time.Time{})
 	}
 
+	if c.ProtocolLevel == 5 {
+		keepAlive, sessionPresent, err = c.readCONNACK5(r)
+		switch {
+		case err == nil:
+			return r, keepAlive, sessionPresent, nil
+		case c.dialCtx.Err() != nil:
+			err = ErrClosed
+		case errors.Is(err, io.EOF): // doesn't match io.ErrUnexpectedEOF
+			err = errBrokerTerm
+		}
+		return nil, 0, false, err
+	}
+
 	// “The first packet sent from the Server to the Client MUST be a
 	// CONNACK Packet.”
 	// — MQTT Version 3.1.1, conformance statement MQTT-3.2.0-1
@@ -928,26 +1934,104 @@ func (c *Client) handshake(conn net.Conn, requestPacket []byte) (*bufio.Reader,
 	case c.dialCtx.Err() != nil:
 		err = ErrClosed
 	case len(packet) > 1 && (packet[0] != typeCONNACK<<4 || packet[1] != 2):
-		return nil, fmt.Errorf("%w: want fixed CONNACK header 0x2002, got %#x", errProtoReset, packet)
+		return nil, 0, false, fmt.Errorf("%w: want fixed CONNACK header 0x2002, got %#x", ErrProtocol, packet)
+	case len(packet) > 2 && packet[2]&^1 != 0:
+		// “Bits 7-1 are reserved and MUST be set to 0.”
+		// — MQTT Version 3.1.1, subsection 3.2.2.1
+		return nil, 0, false, fmt.Errorf("%w: CONNACK with reserved acknowledge flags %#08b", ErrProtocol, packet[2])
 	case len(packet) > 3 && connectReturn(packet[3]) != accepted:
-		return nil, connectReturn(packet[3])
+		return nil, 0, false, &ConnectRefused{Code: packet[3]}
 	case err == nil:
 		r.Discard(len(packet)) // no errors guaranteed
-		return r, nil
+		if c.Metrics != nil {
+			c.Metrics.OnPacketRead(typeCONNACK, len(packet))
+		}
+		return r, c.KeepAlive, packet[2]&1 != 0, nil
 	case errors.Is(err, io.EOF): // doesn't match io.ErrUnexpectedEOF
 		err = errBrokerTerm
 	}
 	if len(packet) != 4 {
 		err = fmt.Errorf("%w; CONNECT not confirmed", err)
 	}
-	return nil, err
+	return nil, 0, false, err
+}
+
+// ReadCONNACK5 reads the acknowledgement of MQTT version 5.0, which has a
+// variable length due to properties.
+func (c *Client) readCONNACK5(r *bufio.Reader) (keepAlive uint16, sessionPresent bool, err error) {
+	// “The first packet sent from the Server to the Client MUST be a
+	// CONNACK packet.”
+	// — MQTT Version 5.0, conformance statement MQTT-3.2.0-1
+	var size, n int
+	for i := 1; n == 0; i++ {
+		header, err := r.Peek(1 + i)
+		if err != nil {
+			return 0, false, fmt.Errorf("%w; CONNECT not confirmed", err)
+		}
+		if header[0] != typeCONNACK<<4 {
+			return 0, false, fmt.Errorf("%w: want CONNACK header 0x20, got %#x", ErrProtocol, header[0])
+		}
+		size, n = readVarint(header[1:])
+		if n == 0 && i >= 4 {
+			return 0, false, fmt.Errorf("%w: CONNACK remaining length encoding exceeds 4 bytes", ErrProtocol)
+		}
+	}
+	packet, err := r.Peek(1 + n + size)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w; CONNECT not confirmed", err)
+	}
+	defer r.Discard(len(packet)) // no errors guaranteed
+	if c.Metrics != nil {
+		c.Metrics.OnPacketRead(typeCONNACK, len(packet))
+	}
+	packet = packet[1+n:]
+
+	// acknowledge flags & reason code
+	if len(packet) < 2 {
+		return 0, false, fmt.Errorf("%w: CONNACK with %d byte remaining length", ErrProtocol, len(packet))
+	}
+	if packet[0]&^1 != 0 {
+		return 0, false, fmt.Errorf("%w: CONNACK with reserved acknowledge flags %#08b", ErrProtocol, packet[0])
+	}
+	reasonCode := packet[1]
+
+	keepAlive = c.KeepAlive
+	c.aliasOutMax = 0
+	atomic.StoreUint32(&c.receiveMax, 0)
+	var reason string
+	if len(packet) > 2 {
+		_, err := eachProperty(packet[2:], func(id byte, value []byte) {
+			switch id {
+			case propServerKeepAlive:
+				keepAlive = binary.BigEndian.Uint16(value)
+			case propTopicAliasMax:
+				c.aliasOutMax = binary.BigEndian.Uint16(value)
+			case propReceiveMax:
+				atomic.StoreUint32(&c.receiveMax, uint32(binary.BigEndian.Uint16(value)))
+			case propReasonString:
+				reason = string(value)
+			}
+		})
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	switch {
+	case reasonCode >= 0x80:
+		return 0, false, &ConnectRefused{Code: reasonCode, Reason: reason}
+	case reasonCode != 0:
+		return 0, false, fmt.Errorf("%w: CONNACK with reason code %#02x", ErrProtocol, reasonCode)
+	}
+	return keepAlive, packet[0]&1 != 0, nil
 }
 
 // ReadSlices should be invoked consecutively from a single goroutine until
 // ErrClosed. An IsDeny implies permantent Config rejection.
 //
-// Both message and topic are slices from a read buffer. The bytes stop being
-// valid at the next read.
+// Both message and topic are slices from a read buffer. The bytes stay valid
+// until the next read, i.e., the next invocation of ReadSlices or any of its
+// variants. Retention beyond that point requires a copy, like ReadMessage does.
 //
 // Each invocation acknowledges ownership of the previously returned if any.
 // Alternatively, use either Disconnect or Close to prevent a confirmation from
@@ -955,33 +2039,210 @@ func (c *Client) handshake(conn net.Conn, requestPacket []byte) (*bufio.Reader,
 //
 // BigMessage leaves the memory allocation choice to the consumer. Any other
 // error puts the Client in an ErrDown state. Invocation should apply a backoff
-// once down. Retries on IsConnectionRefused, if any, should probably apply a
-// rather large backoff. See the Client example for a complete setup.
+// once down, unless Config.AutoReconnect is set. Retries on
+// IsConnectionRefused, if any, should probably apply a rather large backoff.
+// See the Client example for a complete setup.
+//
+// A connection termination by the broker, without any DISCONNECT, results in
+// an error which matches io.EOF with errors.Is. Such loss is recoverable, as
+// opposed to ErrClosed. Requests which await a response at the time receive an
+// ErrBreak. Pending PublishAtLeastOnce and PublishExactlyOnce exchanges receive
+// an ErrDown instead, as they resume once the next ReadSlices reconnects.
 func (c *Client) ReadSlices() (message, topic []byte, err error) {
 	message, topic, err = c.readSlices()
 	switch {
-	case err == c.bigMessage: // either nil or BigMessage
-		break
+	case err == nil:
+		c.countReceive(len(message))
+	case err == c.bigMessage: // BigMessage
+		c.countReceive(c.bigMessage.Size)
 	case errors.Is(err, ErrClosed):
 		c.termCallbacks()
 	}
 	return
 }
 
+// ErrReadTimeout means that no message arrived within the duration of
+// ReadOptions.Timeout. The connection remains in use.
+var ErrReadTimeout = errors.New("mqtt: no message within read timeout")
+
+// ReadOptions are the per-call options for ReadWithOptions. The zero value
+// reads like ReadSlices.
+type ReadOptions struct {
+	// Timeout causes an ErrReadTimeout when no message arrives within the
+	// duration, with zero for none. The Client remains fully functional
+	// after such a timeout. Connect attempts are not bound by the timeout,
+	// and neither are packets which started arriving in time.
+	Timeout time.Duration
+
+	// Copy gets the message and the topic in new buffers, which stay valid
+	// after the next read. BigMessage is read in full.
+	Copy bool
+
+	// TopicFilters gets the topic filters from Subscribe which match the
+	// topic. Messages may match with multiple subscriptions.
+	TopicFilters bool
+
+	// Decode receives the message, e.g., for a json.Unmarshal, when set.
+	// BigMessage is read in full before decoding. Failures are reported as
+	// a *DecodeError.
+	Decode func(message []byte) error
+}
+
+// Inbound is a PUBLISH from ReadWithOptions.
+type Inbound struct {
+	// Both message and topic are slices from a read buffer, like with
+	// ReadSlices, unless ReadOptions.Copy is set.
+	Message, Topic []byte
+
+	// TopicFilters has the matches from ReadOptions.TopicFilters, if any,
+	// in sorted order.
+	TopicFilters []string
+
+	MessageInfo
+}
+
+// MessageInfo has the flags of an inbound PUBLISH.
+type MessageInfo struct {
+	// QoS is the quality-of-service level of the delivery, with 0 for
+	// “at most once”, 1 for “at least once”, and 2 for “exactly once”.
+	QoS byte
+
+	// Retained marks a message from the broker storage, due to a new
+	// subscription, as opposed to a live update. See PublishRetained.
+	Retained bool
+
+	// Duplicate marks a possible redelivery, with QoS 1 or 2 only.
+	Duplicate bool
+
+	// PacketID is the packet identifier, with zero for QoS 0. The value
+	// matches the OnExactlyOnceComplete hook for QoS 2.
+	PacketID uint
+}
+
+// DecodeError is a ReadOptions.Decode failure on the message content. The
+// Client remains fully functional.
+type DecodeError struct {
+	Topic string // source
+	Err   error  // from the decode function
+}
+
+// Error implements the standard error interface.
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("mqtt: message from %q not decoded: %s", e.Topic, e.Err)
+}
+
+// Unwrap returns the decode function error.
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// ReadWithOptions is like ReadSlices, but with ReadOptions, and with the
+// message in an Inbound. The Inbound applies to BigMessage errors too, with
+// the message left to the consumer, unless ReadOptions.Copy or Decode is set.
+func (c *Client) ReadWithOptions(o ReadOptions) (Inbound, error) {
+	if o.Timeout != 0 {
+		c.readDeadline = time.Now().Add(o.Timeout)
+		defer func() { c.readDeadline = time.Time{} }()
+	}
+
+	message, topic, err := c.ReadSlices()
+	switch {
+	case err == nil:
+		if o.Copy {
+			message = append([]byte(nil), message...)
+			topic = append([]byte(nil), topic...)
+		}
+	case err == c.bigMessage: // BigMessage
+		topic = []byte(c.bigMessage.Topic)
+		if o.Copy || o.Decode != nil {
+			message, err = c.bigMessage.ReadAll()
+			if err != nil {
+				return Inbound{}, err
+			}
+		}
+	default:
+		return Inbound{}, err
+	}
+
+	in := Inbound{
+		Message: message,
+		Topic:   topic,
+		MessageInfo: MessageInfo{
+			QoS:       c.publishHead >> 1 & 3,
+			Retained:  c.publishHead&retainFlag != 0,
+			Duplicate: c.publishHead&dupeFlag != 0,
+			PacketID:  c.publishID,
+		},
+	}
+	if o.TopicFilters {
+		in.TopicFilters = c.subs.match(string(topic))
+	}
+	if o.Decode != nil {
+		if decodeErr := o.Decode(message); decodeErr != nil {
+			return in, &DecodeError{Topic: string(topic), Err: decodeErr}
+		}
+	}
+	return in, err
+}
+
+// ReadSlicesTimeout is like ReadSlices, but it returns ErrReadTimeout when no
+// message arrives within d. See ReadOptions.Timeout.
+func (c *Client) ReadSlicesTimeout(d time.Duration) (message, topic []byte, err error) {
+	in, err := c.ReadWithOptions(ReadOptions{Timeout: d})
+	return in.Message, in.Topic, err
+}
+
+// ReadSlicesFilters is like ReadSlices, with the topic filters from Subscribe
+// which match the topic in addition, if any. Messages may match with multiple
+// subscriptions. The topic filters are in sorted order.
+func (c *Client) ReadSlicesFilters() (message, topic []byte, topicFilters []string, err error) {
+	in, err := c.ReadWithOptions(ReadOptions{TopicFilters: true})
+	return in.Message, in.Topic, in.TopicFilters, err
+}
+
+// ReadSlicesInfo is like ReadSlices, with the MessageInfo in addition. The info
+// applies to BigMessage errors too.
+func (c *Client) ReadSlicesInfo() (message, topic []byte, info MessageInfo, err error) {
+	in, err := c.ReadWithOptions(ReadOptions{})
+	return in.Message, in.Topic, in.MessageInfo, err
+}
+
+// ReadMessage is like ReadSlices, but with a copy of the message which stays
+// valid after the next read. BigMessage is read in full.
+func (c *Client) ReadMessage() (message []byte, topic string, err error) {
+	in, err := c.ReadWithOptions(ReadOptions{Copy: true})
+	return in.Message, string(in.Topic), err
+}
+
+// ReadDecode is like ReadSlices, but with the message passed to decode, e.g.,
+// json.Unmarshal, to fill v. BigMessage is read in full before decoding.
+// Decode failures are reported as a *DecodeError.
+func (c *Client) ReadDecode(v interface{}, decode func([]byte, interface{}) error) (topic string, err error) {
+	in, err := c.ReadWithOptions(ReadOptions{Decode: func(message []byte) error {
+		return decode(message, v)
+	}})
+	return string(in.Topic), err
+}
+
 func (c *Client) readSlices() (message, topic []byte, err error) {
 	// A pending BigMessage implies that the connection was functional on
 	// the last return.
 	switch {
 	case c.bigMessage != nil:
 		<-c.Online() // extra verification
-		_, err = c.r.Discard(c.bigMessage.Size)
+		_, err = c.r.Discard(c.bigMessage.Size - c.bigMessage.readN)
+		c.bigMessage = nil
 		if err != nil {
 			c.toOffline()
 			return nil, nil, err
 		}
 
 	case c.readConn == nil:
-		if err := c.connect(); err != nil {
+		var err error
+		if c.connected {
+			err = c.reconnect()
+		} else {
+			err = c.connectRetry()
+		}
+		if err != nil {
 			return nil, nil, err
 		}
 		<-c.Online() // extra verification
@@ -993,24 +2254,14 @@ func (c *Client) readSlices() (message, topic []byte, err error) {
 		c.peek = nil             // flush
 	}
 
+	if c.holdTimer != nil {
+		c.holdTimer.Stop()
+		c.holdTimer = nil
+	}
+
 	// acknowledge previous packet, if any
-	if len(c.pendingAck) != 0 {
-		if c.pendingAck[0]>>4 == typePUBREC {
-			// BUG(pascaldekloe): Save errors from a Persistence may
-			// cause duplicate reception for deliveries with an
-			// “exactly once guarantee”, if the respective Client
-			// goes down before a recovery/retry succeeds.
-			key := uint(binary.BigEndian.Uint16(c.pendingAck[2:4])) | remoteIDKeyFlag
-			err = c.persistence.Save(key, net.Buffers{c.pendingAck})
-			if err != nil {
-				return nil, nil, err
-			}
-		}
-		err := c.write(nil, c.pendingAck)
-		if err != nil {
-			return nil, nil, err // keeps pendingAck to retry
-		}
-		c.pendingAck = c.pendingAck[:0]
+	if err := c.ackPending(); err != nil {
+		return nil, nil, err
 	}
 
 	// process packets until a PUBLISH appears
@@ -1020,10 +2271,19 @@ func (c *Client) readSlices() (message, topic []byte, err error) {
 		case err == nil:
 			break
 
+		case err == ErrReadTimeout:
+			return nil, nil, err // connection remains
+
 		case errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe):
 			// got interrupted
 			c.toOffline()
-			if err := c.connect(); err != nil {
+			select {
+			case <-c.pongLost:
+				return nil, nil, errPongLost
+			default:
+				break
+			}
+			if err := c.reconnect(); err != nil {
 				c.readConn = nil
 				return nil, nil, err
 			}
@@ -1047,6 +2307,7 @@ func (c *Client) readSlices() (message, topic []byte, err error) {
 				c.r.Discard(done) // no errors guaranteed
 			}
 			c.peek = nil
+			c.publishHead = head
 			return nil, nil, c.bigMessage
 
 		default:
@@ -1064,7 +2325,22 @@ func (c *Client) readSlices() (message, topic []byte, err error) {
 		case typePUBLISH:
 			message, topic, err = c.onPUBLISH(head)
 			if err == nil {
-				return message, topic, nil
+				if head&retainFlag == 0 || !time.Now().Before(c.retainedDrop) {
+					c.publishHead = head
+					return message, topic, nil
+				}
+				// dropped [DropRetained]
+				if c.holdTimer != nil {
+					c.holdTimer.Stop()
+					c.holdTimer = nil
+				}
+				if head&0b0110 == exactlyOnceLevel<<1 {
+					if c.droppedExactlyOnce == nil {
+						c.droppedExactlyOnce = make(map[uint]struct{})
+					}
+					c.droppedExactlyOnce[uint(binary.BigEndian.Uint16(c.pendingAck[2:4]))] = struct{}{}
+				}
+				err = c.ackPending()
 			}
 			if err == errDupe {
 				err = nil // just skip
@@ -1090,7 +2366,7 @@ func (c *Client) readSlices() (message, topic []byte, err error) {
 		case typePINGRESP:
 			err = c.onPINGRESP()
 		case typeDISCONNECT:
-			err = errGotDISCONNECT
+			err = c.onDISCONNECT()
 		case typeRESERVED15:
 			err = errRESERVED15
 		}
@@ -1104,13 +2380,67 @@ func (c *Client) readSlices() (message, topic []byte, err error) {
 	}
 }
 
+// AckPending sends the pendingAck, if any.
+func (c *Client) ackPending() error {
+	if len(c.pendingAck) == 0 {
+		return nil
+	}
+	if c.pendingAck[0]>>4 == typePUBREC {
+		// BUG(pascaldekloe): Save errors from a Persistence may
+		// cause duplicate reception for deliveries with an
+		// “exactly once guarantee”, if the respective Client
+		// goes down before a recovery/retry succeeds.
+		key := uint(binary.BigEndian.Uint16(c.pendingAck[2:4])) | remoteIDKeyFlag
+		err := c.persistence.Save(key, net.Buffers{c.pendingAck})
+		if err != nil {
+			return err
+		}
+	}
+	err := c.write(nil, c.pendingAck)
+	if err != nil {
+		return err // keeps pendingAck to retry
+	}
+	c.pendingAck = c.pendingAck[:0]
+	return nil
+}
+
+// OnDISCONNECT reads a termination from the broker, which is legal with MQTT
+// version 5.0 only.
+func (c *Client) onDISCONNECT() error {
+	if c.ProtocolLevel != 5 {
+		return errGotDISCONNECT
+	}
+	var reasonCode byte // normal disconnection
+	var reason string
+	if len(c.peek) != 0 {
+		reasonCode = c.peek[0]
+	}
+	if len(c.peek) > 1 {
+		_, err := eachProperty(c.peek[1:], func(id byte, value []byte) {
+			if id == propReasonString {
+				reason = string(value)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if reason != "" {
+		return fmt.Errorf("mqtt: broker disconnected with reason code %#02x; %s", reasonCode, reason)
+	}
+	return fmt.Errorf("mqtt: broker disconnected with reason code %#02x", reasonCode)
+}
+
 // BigMessage signals reception beyond the read buffer capacity.
 // Receivers may or may not allocate the memory with ReadAll.
-// The next ReadSlices will acknowledge reception either way.
+// Read streams the message instead. The next ReadSlices will
+// acknowledge reception either way, and it skips any remainder.
 type BigMessage struct {
 	*Client        // source
 	Topic   string // destinition
 	Size    int    // byte count
+
+	readN int // streamed with Read
 }
 
 // Error implements the standard error interface.
@@ -1118,16 +2448,50 @@ func (e *BigMessage) Error() string {
 	return fmt.Sprintf("mqtt: %d B message exceeds read buffer capacity", e.Size)
 }
 
-// ReadAll returns the message in a new/dedicated buffer. Messages can be read
-// only once, after reception (from ReadSlices), and before the next ReadSlices.
-// The invocation must occur from within the same routine.
+var errBigMessageExpired = errors.New("mqtt: read window expired for a big message")
+
+// Read implements the io.Reader interface. The message streams straight from
+// the connection, without any buffer allocation. Messages can be read only
+// once, after reception (from ReadSlices), and before the next ReadSlices. The
+// invocation must occur from within the same routine.
+func (e *BigMessage) Read(p []byte) (n int, err error) {
+	if e.readN >= e.Size {
+		return 0, io.EOF
+	}
+	if e.bigMessage != e {
+		return 0, errBigMessageExpired
+	}
+
+	if remaining := e.Size - e.readN; len(p) > remaining {
+		p = p[:remaining]
+	}
+	n, err = e.Client.r.Read(p)
+	e.readN += n
+	if err != nil {
+		e.bigMessage = nil
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		e.Client.toOffline()
+		return n, err
+	}
+	if e.readN >= e.Size {
+		e.bigMessage = nil // done
+	}
+	return n, nil
+}
+
+// ReadAll returns the message in a new/dedicated buffer. Any bytes consumed
+// with Read are excluded. Messages can be read only once, after reception (from
+// ReadSlices), and before the next ReadSlices. The invocation must occur from
+// within the same routine.
 func (e *BigMessage) ReadAll() ([]byte, error) {
 	if e.bigMessage != e {
-		return nil, errors.New("mqtt: read window expired for a big message")
+		return nil, errBigMessageExpired
 	}
 	e.bigMessage = nil
 
-	message := make([]byte, e.Size)
+	message := make([]byte, e.Size-e.readN)
 	_, err := io.ReadFull(e.Client.r, message)
 	if err != nil {
 		e.Client.toOffline()
@@ -1141,41 +2505,56 @@ var errDupe = errors.New("mqtt: duplicate reception")
 // OnPUBLISH slices an inbound message from Client.peek.
 func (c *Client) onPUBLISH(head byte) (message, topic []byte, err error) {
 	if len(c.peek) < 2 {
-		return nil, nil, fmt.Errorf("%w: PUBLISH with %d byte remaining length", errProtoReset, len(c.peek))
+		return nil, nil, fmt.Errorf("%w: PUBLISH with %d byte remaining length", ErrProtocol, len(c.peek))
 	}
 	i := int(uint(binary.BigEndian.Uint16(c.peek))) + 2
 	if i > len(c.peek) {
-		return nil, nil, fmt.Errorf("%w: PUBLISH topic exceeds remaining length", errProtoReset)
+		return nil, nil, fmt.Errorf("%w: PUBLISH topic exceeds remaining length", ErrProtocol)
 	}
 	topic = c.peek[2:i]
 
+	var packetID uint
+	defer func() { c.publishID = packetID }()
 	switch head & 0b0110 {
 	case atMostOnceLevel << 1:
 		break
-
-	case atLeastOnceLevel << 1:
+	case atLeastOnceLevel << 1, exactlyOnceLevel << 1:
 		if len(c.peek) < i+2 {
-			return nil, nil, fmt.Errorf("%w: PUBLISH packet identifier exceeds remaining length", errProtoReset)
+			return nil, nil, fmt.Errorf("%w: PUBLISH packet identifier exceeds remaining length", ErrProtocol)
 		}
-		packetID := binary.BigEndian.Uint16(c.peek[i:])
+		packetID = uint(binary.BigEndian.Uint16(c.peek[i:]))
 		if packetID == 0 {
 			return nil, nil, errPacketIDZero
 		}
 		i += 2
+	default:
+		return nil, nil, fmt.Errorf("%w: PUBLISH with reserved quality-of-service level 3", ErrProtocol)
+	}
 
+	if c.ProtocolLevel == 5 {
+		var alias uint16
+		n, err := eachProperty(c.peek[i:], func(id byte, value []byte) {
+			if id == propTopicAlias {
+				alias = binary.BigEndian.Uint16(value)
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		i += n
+
+		topic, err = c.topicAlias(topic, alias)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch head & 0b0110 {
+	case atLeastOnceLevel << 1:
 		// enqueue for next call
 		c.pendingAck = append(c.pendingAck, typePUBACK<<4, 2, byte(packetID>>8), byte(packetID))
 
 	case exactlyOnceLevel << 1:
-		if len(c.peek) < i+2 {
-			return nil, nil, fmt.Errorf("%w: PUBLISH packet identifier exceeds remaining length", errProtoReset)
-		}
-		packetID := uint(binary.BigEndian.Uint16(c.peek[i:]))
-		if packetID == 0 {
-			return nil, nil, errPacketIDZero
-		}
-		i += 2
-
 		bytes, err := c.persistence.Load(packetID | remoteIDKeyFlag)
 		if err != nil {
 			return nil, nil, err
@@ -1186,18 +2565,46 @@ func (c *Client) onPUBLISH(head byte) (message, topic []byte, err error) {
 
 		// enqueue for next call
 		c.pendingAck = append(c.pendingAck, typePUBREC<<4, 2, byte(packetID>>8), byte(packetID))
-
-	default:
-		return nil, nil, fmt.Errorf("%w: PUBLISH with reserved quality-of-service level 3", errProtoReset)
+		if c.HoldTimeout != 0 {
+			timeout := c.HoldTimeout
+			c.holdTimer = time.AfterFunc(timeout, func() {
+				c.warn(fmt.Errorf("mqtt: PUBLISH %#04x with “exactly once” guarantee on hold for more than %s; ReadSlices not called", packetID, timeout))
+			})
+		}
 	}
 
 	return c.peek[i:], topic, nil
 }
 
+// TopicAlias applies the topic alias of an inbound PUBLISH, if any. An empty
+// topic is resolved with the alias.
+func (c *Client) topicAlias(topic []byte, alias uint16) ([]byte, error) {
+	switch {
+	case alias == 0 && len(topic) == 0:
+		return nil, fmt.Errorf("%w: PUBLISH without topic nor topic alias", ErrProtocol)
+	case alias == 0:
+		return topic, nil
+	case alias > c.TopicAliasMax:
+		return nil, fmt.Errorf("%w: PUBLISH topic alias %d exceeds the maximum of %d", ErrProtocol, alias, c.TopicAliasMax)
+	case len(topic) != 0:
+		if c.topicAliases == nil {
+			c.topicAliases = make(map[uint16][]byte)
+		}
+		c.topicAliases[alias] = append(c.topicAliases[alias][:0], topic...)
+		return topic, nil
+	}
+	topic, ok := c.topicAliases[alias]
+	if !ok {
+		return nil, fmt.Errorf("%w: PUBLISH with unknown topic alias %d", ErrProtocol, alias)
+	}
+	return topic, nil
+}
+
 // OnPUBREL applies the second round-trip for “exactly-once” reception.
 func (c *Client) onPUBREL() error {
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: PUBREL with %d byte remaining length", errProtoReset, len(c.peek))
+	// A failure [packet identifier not found] needs a PUBCOMP all the same.
+	if _, err := c.ackFailure("PUBREL"); err != nil {
+		return err
 	}
 	packetID := uint(binary.BigEndian.Uint16(c.peek))
 	if packetID == 0 {
@@ -1215,5 +2622,12 @@ func (c *Client) onPUBREL() error {
 		return err // causes resubmission of PUBCOMP
 	}
 	c.pendingAck = c.pendingAck[:0]
+	if _, ok := c.droppedExactlyOnce[packetID]; ok {
+		delete(c.droppedExactlyOnce, packetID)
+		return nil // never returned by ReadSlices
+	}
+	if c.OnExactlyOnceComplete != nil {
+		c.OnExactlyOnceComplete(packetID)
+	}
 	return nil
 }
@@ -1,12 +1,27 @@
 package mqtt_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -366,29 +381,2625 @@ func TestDown(t *testing.T) {
 	}
 }
 
+func TestConnectRetry(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	var dialN int32
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		ConnectRetry: time.Second,
+		RetryDelay:   time.Millisecond,
+		Dialer: func(context.Context) (net.Conn, error) {
+			if atomic.AddInt32(&dialN, 1) < 3 {
+				return nil, errors.New("broker not ready yet")
+			}
+			return clientEnd, nil
+		},
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+
+	testClient(t, client, mqtttest.Transfer{Message: []byte("hello"), Topic: "greet"})
+	wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	sendPacketHex(t, brokerEnd, hex.EncodeToString([]byte{
+		0x30, 12,
+		0, 5, 'g', 'r', 'e', 'e', 't',
+		'h', 'e', 'l', 'l', 'o'}))
+	if n := atomic.LoadInt32(&dialN); n != 3 {
+		t.Errorf("got %d Dialer invocations, want 3", n)
+	}
+}
+
+func TestConnectRetryRefused(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		ConnectRetry: time.Second,
+		RetryDelay:   time.Millisecond,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020005") // CONNACK
+	})
+	_, _, err = client.ReadSlices()
+	if !errors.Is(err, mqtt.ErrAuth) {
+		t.Errorf("ReadSlices got error %q, want an ErrAuth", err)
+	}
+	<-brokerMockDone
+}
+
+func TestAutoReconnect(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	var dialTimes []time.Time
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		AutoReconnect: true,
+		RetryDelay:    time.Second / 32,
+		RetryDelayMax: time.Second / 16,
+		Dialer: func(context.Context) (net.Conn, error) {
+			dialTimes = append(dialTimes, time.Now())
+			if len(dialTimes) == 1 {
+				return clientEnd, nil
+			}
+			return nil, errors.New("broker gone")
+		},
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		brokerEnd.Close()
+	})
+	_, _, err = client.ReadSlices()
+	<-brokerMockDone
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("ReadSlices got error %v, want an io.EOF", err)
+	}
+	for i := 0; i < 4; i++ {
+		_, _, err = client.ReadSlices()
+		if err == nil || err.Error() != "broker gone" {
+			t.Fatalf("ReadSlices retry %d got error %v, want the Dialer error", i+1, err)
+		}
+	}
+
+	if len(dialTimes) != 5 {
+		t.Fatalf("got %d Dialer invocations, want 5", len(dialTimes))
+	}
+	// first reconnect without delay
+	for i, min := range []time.Duration{time.Second / 32, time.Second / 16, time.Second / 16} {
+		if d := dialTimes[i+2].Sub(dialTimes[i+1]); d < min {
+			t.Errorf("dial %d got %s after the previous, want at least %s", i+3, d, min)
+		}
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	t.Parallel()
+
+	for code, want := range []error{
+		1: mqtt.ErrProtocolLevel,
+		2: mqtt.ErrClientID,
+		3: mqtt.ErrUnavailable,
+		4: mqtt.ErrAuthBad,
+		5: mqtt.ErrAuth,
+		6: nil, // reserved
+	} {
+		if code == 0 {
+			continue
+		}
+
+		clientEnd, brokerEnd := net.Pipe()
+		client, err := mqtt.VolatileSession("", &mqtt.Config{
+			PauseTimeout: time.Second / 4,
+			Dialer:       newTestDialer(t, clientEnd),
+		})
+		if err != nil {
+			t.Fatal("volatile session error:", err)
+		}
+
+		brokerMockDone := testRoutine(t, func() {
+			wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+			sendPacketHex(t, brokerEnd, hex.EncodeToString([]byte{0x20, 2, 0, byte(code)})) // CONNACK
+		})
+		_, _, err = client.ReadSlices()
+		<-brokerMockDone
+		client.Close()
+
+		var refused *mqtt.ConnectRefused
+		switch {
+		case !errors.As(err, &refused):
+			t.Errorf("code %d: ReadSlices got error %q [%T], want a *mqtt.ConnectRefused", code, err, err)
+		case refused.Code != byte(code):
+			t.Errorf("code %d: got ConnectRefused with code %d", code, refused.Code)
+		case !mqtt.IsConnectionRefused(err):
+			t.Errorf("code %d: error %q is not an IsConnectionRefused", code, err)
+		case want != nil && !errors.Is(err, want):
+			t.Errorf("code %d: got error %q, want errors.Is %q", code, err, want)
+		}
+	}
+}
+
+func TestWarm(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+
+	quit := make(chan struct{})
+	close(quit)
+	err = client.Warm(quit)
+	if !errors.Is(err, mqtt.ErrCanceled) {
+		t.Errorf("Warm before connect got error %q, want an ErrCanceled", err)
+	}
+
+	testClient(t, client)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	})
+
+	err = client.Warm(nil)
+	if err != nil {
+		t.Errorf("Warm got error %q [%T]", err, err)
+	}
+	select {
+	case <-client.Online():
+		break // OK
+	default:
+		t.Error("online signal blocked after Warm")
+	}
+	<-brokerMockDone
+}
+
+func TestWarmReconnect(t *testing.T) {
+	t.Parallel()
+
+	clientEnd1, brokerEnd1 := net.Pipe()
+	clientEnd2, brokerEnd2 := net.Pipe()
+	var dialN int
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		AutoReconnect: true,
+		RetryDelay:    time.Minute,
+		Dialer: func(context.Context) (net.Conn, error) {
+			dialN++
+			switch dialN {
+			case 1:
+				return clientEnd1, nil
+			case 2:
+				return nil, errors.New("broker gone")
+			default:
+				return clientEnd2, nil
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd1, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd1, "20020000") // CONNACK
+		brokerEnd1.Close()
+	})
+	_, _, err = client.ReadSlices()
+	<-brokerMockDone
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("ReadSlices got error %v, want an io.EOF", err)
+	}
+	_, _, err = client.ReadSlices()
+	if err == nil || err.Error() != "broker gone" {
+		t.Fatalf("ReadSlices got error %v, want the Dialer error", err)
+	}
+
+	// next reconnect awaits RetryDelay
+	readDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("ReadSlices got error %v, want an mqtt.ErrClosed", err)
+		}
+	})
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd2, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd2, "20020000") // CONNACK
+	})
+	quit := make(chan struct{})
+	timer := time.AfterFunc(time.Second, func() { close(quit) })
+	defer timer.Stop()
+	if err := client.Warm(quit); err != nil {
+		t.Error("Warm error:", err)
+	}
+	<-brokerMockDone
+	client.Close()
+	<-readDone
+}
+
+func TestCONNACKReservedFlags(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020200") // CONNACK with flag bit 1
+	})
+	_, _, err = client.ReadSlices()
+	<-brokerMockDone
+	if !errors.Is(err, mqtt.ErrProtocol) {
+		t.Errorf("ReadSlices got error %q, want an mqtt.ErrProtocol", err)
+	}
+	if mqtt.IsConnectionRefused(err) {
+		t.Errorf("error %q is an IsConnectionRefused", err)
+	}
+}
+
+func TestTopicAlias(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		ProtocolLevel: 5,
+		TopicAliasMax: 4,
+		Dialer:        newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+
+	testClient(t, client,
+		mqtttest.Transfer{Message: []byte("hi"), Topic: "t"},
+		mqtttest.Transfer{Message: []byte("hi"), Topic: "t"},
+	)
+	wantPacketHex(t, brokerEnd, "101500044d515454050000"+"000811ffffffff220004"+"0000")
+	sendPacketHex(t, brokerEnd, "20030000"+"00") // CONNACK
+	// PUBLISH with topic "t" installed as alias 1
+	sendPacketHex(t, brokerEnd, "3009000174"+"03230001"+"6869")
+	// PUBLISH with alias 1 only
+	sendPacketHex(t, brokerEnd, "30080000"+"03230001"+"6869")
+}
+
+func TestTopicAliasOut(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ProtocolLevel:  5,
+		AtLeastOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	// CONNACK with a Topic Alias Maximum of 1
+	sendPacketHex(t, brokerEnd, "20060000"+"03220001")
+	<-client.Online()
+
+	brokerMockDone := testRoutine(t, func() {
+		// PUBLISH with topic "t" installed as alias 1
+		wantPacketHex(t, brokerEnd, "3009000174"+"03230001"+"6869")
+		// PUBLISH with alias 1 only
+		wantPacketHex(t, brokerEnd, "30080000"+"03230001"+"6869")
+		// PUBLISH with alias 1 and a message expiry
+		wantPacketHex(t, brokerEnd, "300d0000"+"08230001020000003c"+"6869")
+		// PUBLISH without alias, as the maximum is reached
+		wantPacketHex(t, brokerEnd, "3006000175"+"00"+"6869")
+		// PUBLISH without alias, as it persists
+		wantPacketHex(t, brokerEnd, "3208000174"+"8000"+"00"+"6869")
+	})
+	for _, topic := range []string{"t", "t"} {
+		if err := client.Publish(nil, []byte("hi"), topic); err != nil {
+			t.Fatal("publish error:", err)
+		}
+	}
+	err = client.PublishWithOptions(nil, []byte("hi"), "t", mqtt.PublishOptions{MessageExpiry: 60})
+	if err != nil {
+		t.Fatal("publish with options error:", err)
+	}
+	if err := client.Publish(nil, []byte("hi"), "u"); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	if _, err := client.PublishAtLeastOnce([]byte("hi"), "t"); err != nil {
+		t.Fatal("publish at least once error:", err)
+	}
+	<-brokerMockDone
+}
+
+func TestConnectRefused5(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		ProtocolLevel: 5,
+		Dialer:        newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "101200044d51545405000000"+"0511ffffffff"+"0000")
+		// CONNACK with reason code bad user name or password,
+		// and with a reason string "no"
+		sendPacketHex(t, brokerEnd, "20080086"+"051f00026e6f")
+	})
+	_, _, err = client.ReadSlices()
+	<-brokerMockDone
+
+	var refused *mqtt.ConnectRefused
+	switch {
+	case !errors.As(err, &refused):
+		t.Errorf("ReadSlices got error %q [%T], want a *mqtt.ConnectRefused", err, err)
+	case refused.Code != 0x86 || refused.Reason != "no":
+		t.Errorf("got ConnectRefused with code %#02x and reason %q, want 0x86 and \"no\"", refused.Code, refused.Reason)
+	case !errors.Is(err, mqtt.ErrAuthBad):
+		t.Errorf("error %q is not an mqtt.ErrAuthBad", err)
+	}
+}
+
+func TestClientIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:      time.Second / 4,
+		Dialer:            newTestDialer(t, clientEnd),
+		ClientIDGenerator: func() string { return "gen" },
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "100f00044d51545404000000"+"000367656e")
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	<-client.Online()
+}
+
+func TestRandomClientID(t *testing.T) {
+	a, b := mqtt.RandomClientID(), mqtt.RandomClientID()
+	if a == b {
+		t.Errorf("got %q twice", a)
+	}
+	for _, s := range []string{a, b} {
+		if len(s) != 23 || strings.Trim(s, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			t.Errorf("got client identifier %q, want 23 alphanumerics", s)
+		}
+	}
+}
+
+func TestEffectiveKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		KeepAlive:    30,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	if got := client.EffectiveKeepAlive(); got != 0 {
+		t.Errorf("got keep-alive %s before connect, want 0", got)
+	}
+
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "100c00044d5154540400001e0000")
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	<-client.Online()
+	if got, want := client.EffectiveKeepAlive(), 30*time.Second; got != want {
+		t.Errorf("got keep-alive %s, want %s", got, want)
+	}
+}
+
+func TestProtocolLevel5(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		KeepAlive:      30,
+		ProtocolLevel:  5,
+		AtLeastOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+
+	testClient(t, client, mqtttest.Transfer{Message: []byte("hi"), Topic: "t"})
+	wantPacketHex(t, brokerEnd, "101200044d5154540500001e"+"0511ffffffff"+"0000")
+	// CONNACK with a Server Keep Alive of 60 seconds
+	sendPacketHex(t, brokerEnd, "20060000"+"0313003c")
+	<-client.Online()
+	if got, want := client.EffectiveKeepAlive(), 60*time.Second; got != want {
+		t.Errorf("got keep-alive %s, want %s", got, want)
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "32080001748000006869")
+		// PUBACK with reason code quota exceeded
+		sendPacketHex(t, brokerEnd, "4003800097")
+	})
+	exchange, err := client.PublishAtLeastOnce([]byte("hi"), "t")
+	if err != nil {
+		t.Fatal("PublishAtLeastOnce error:", err)
+	}
+	<-brokerMockDone
+	select {
+	case err, ok := <-exchange:
+		if !ok || err == nil {
+			t.Error("exchange got no error for PUBACK failure")
+		} else if !strings.Contains(err.Error(), "0x97") {
+			t.Errorf("exchange got error %q, want reason code 0x97", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exchange timeout")
+	}
+
+	// PUBLISH without properties
+	sendPacketHex(t, brokerEnd, "3006000174006869")
+}
+
+func TestKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		KeepAlive:    1,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	readDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if err == nil || !strings.Contains(err.Error(), "PINGRESP") {
+			t.Errorf("ReadSlices got error %v, want PINGRESP absence", err)
+		}
+	})
+
+	wantPacketHex(t, brokerEnd, "100c00044d5154540400000100"+"00")
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	wantPacketHex(t, brokerEnd, "c000")     // PINGREQ
+	sendPacketHex(t, brokerEnd, "d000")     // PINGRESP
+	wantPacketHex(t, brokerEnd, "c000")     // PINGREQ
+	// no PINGRESP
+	<-readDone
+}
+
+// The keep-alive and Ping must not take each other's PINGRESP.
+func TestKeepAlivePing(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		KeepAlive:    1,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	readDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("ReadSlices got error %v, want mqtt.ErrClosed", err)
+		}
+	})
+	wantPacketHex(t, brokerEnd, "100c00044d5154540400000100"+"00")
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+
+	// Ping during keep-alive
+	wantPacketHex(t, brokerEnd, "c000") // PINGREQ from keep-alive
+	pingDone := testRoutine(t, func() {
+		if err := client.Ping(nil); err != nil {
+			t.Error("ping during keep-alive got error:", err)
+		}
+	})
+	wantPacketHex(t, brokerEnd, "c000") // PINGREQ from Ping
+	sendPacketHex(t, brokerEnd, "d000") // PINGRESP
+	sendPacketHex(t, brokerEnd, "d000") // PINGRESP
+	<-pingDone
+
+	// keep-alive during Ping
+	pingDone = testRoutine(t, func() {
+		if err := client.Ping(nil); err != nil {
+			t.Error("ping over keep-alive got error:", err)
+		}
+	})
+	wantPacketHex(t, brokerEnd, "c000") // PINGREQ from Ping
+	// The keep-alive expires in the mean time, without a PINGREQ.
+	if err := brokerEnd.SetReadDeadline(time.Now().Add(time.Second * 3 / 2)); err != nil {
+		t.Fatal("broker mock got deadline error:", err)
+	}
+	var buf [2]byte
+	if n, err := brokerEnd.Read(buf[:]); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("broker got %#x with error %v during pending Ping, want deadline expiry", buf[:n], err)
+	}
+	if err := brokerEnd.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal("broker mock got deadline error:", err)
+	}
+	sendPacketHex(t, brokerEnd, "d000") // PINGRESP
+	<-pingDone
+
+	// connection remains in use
+	wantPacketHex(t, brokerEnd, "c000") // PINGREQ from keep-alive
+	sendPacketHex(t, brokerEnd, "d000") // PINGRESP
+	if err := client.Close(); err != nil {
+		t.Error("close error:", err)
+	}
+	<-readDone
+}
+
+func TestReadTimeout(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	})
+	_, err = client.ReadWithOptions(mqtt.ReadOptions{Timeout: time.Second / 8})
+	<-brokerMockDone
+	if err != mqtt.ErrReadTimeout {
+		t.Fatalf("read got error %v, want mqtt.ErrReadTimeout", err)
+	}
+	select {
+	case <-client.Online():
+		break // OK
+	default:
+		t.Error("offline after read timeout")
+	}
+
+	brokerMockDone = testRoutine(t, func() {
+		sendPacketHex(t, brokerEnd, "3004000178ff") // PUBLISH
+	})
+	in, err := client.ReadWithOptions(mqtt.ReadOptions{Timeout: time.Second})
+	<-brokerMockDone
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(in.Message) != "\xff" || string(in.Topic) != "x" {
+		t.Errorf("got message %#x @ %q, want 0xff @ \"x\"", in.Message, in.Topic)
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	<-client.Online()
+
+	// Close from multiple routines, while the read routine is active.
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.Close(); err != nil {
+				t.Error("got close error:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-client.Offline():
+		break
+	case <-time.After(time.Second):
+		t.Fatal("offline signal blocked after close")
+	}
+	if err := client.Close(); err != nil {
+		t.Error("got error on close after close:", err)
+	}
+	if err := client.Disconnect(nil); !errors.Is(err, mqtt.ErrClosed) {
+		t.Errorf("got disconnect error %v after close, want an ErrClosed", err)
+	}
+}
+
+func TestCloseGrace(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second,
+		CloseGrace:   time.Second,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	<-client.Online()
+
+	// PUBLISH blocks on the pipe until read
+	publishDone := testRoutine(t, func() {
+		if err := client.Publish(nil, []byte("hello"), "greet"); err != nil {
+			t.Error("publish error:", err)
+		}
+	})
+	// write in progress after the first byte
+	var head [1]byte
+	if _, err := io.ReadFull(brokerEnd, head[:]); err != nil {
+		t.Fatal("broker read error:", err)
+	}
+	if head[0] != 0x30 {
+		t.Fatalf("broker got packet head %#x, want PUBLISH 0x30", head[0])
+	}
+	closeDone := testRoutine(t, func() {
+		if err := client.Close(); err != nil {
+			t.Error("close error:", err)
+		}
+	})
+	// remainder arrives regardless of Close
+	var tail [13]byte
+	if _, err := io.ReadFull(brokerEnd, tail[:]); err != nil {
+		t.Fatal("broker read error after the first byte:", err)
+	}
+	if got, want := hex.EncodeToString(tail[:]), "0c0005677265657468656c6c6f"; got != want {
+		t.Errorf("broker got 0x30%s, want 0x30%s", got, want)
+	}
+	<-publishDone
+	<-closeDone
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	reserved := make(chan uint)
+	release := make(chan struct{})
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		AtLeastOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd),
+		OnReserve: func(packetID uint) {
+			reserved <- packetID
+			<-release
+		},
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+
+	// hold the submission between the shutdown check and its queue
+	exchangeQ := make(chan (<-chan error), 1)
+	go func() {
+		exchange, err := client.PublishAtLeastOnce([]byte("x1"), "t")
+		if err != nil {
+			t.Error("publish error:", err)
+		}
+		exchangeQ <- exchange
+	}()
+	<-reserved
+
+	shutdownDone := testRoutine(t, func() {
+		if err := client.Shutdown(nil); err != nil {
+			t.Error("shutdown error:", err)
+		}
+	})
+	// no DISCONNECT while the submission is on hold
+	brokerEnd.SetReadDeadline(time.Now().Add(time.Second / 8))
+	var buf [1]byte
+	n, err := brokerEnd.Read(buf[:])
+	var e net.Error
+	if !errors.As(err, &e) || !e.Timeout() {
+		t.Errorf("broker got %#x with error %q during submission, want a Timeout net.Error", buf[:n], err)
+	}
+	brokerEnd.SetReadDeadline(time.Time{})
+	close(release)
+	wantPacketHex(t, brokerEnd, "320700017480007831")
+	exchange := <-exchangeQ
+	if exchange == nil {
+		return
+	}
+	sendPacketHex(t, brokerEnd, "40028000") // PUBACK
+	if err := <-exchange; err != nil {
+		t.Error("exchange error:", err)
+	}
+	wantPacketHex(t, brokerEnd, "e000") // DISCONNECT
+	<-shutdownDone
+
+	err = client.Publish(nil, []byte("x2"), "t")
+	if !errors.Is(err, mqtt.ErrClosed) || !strings.Contains(err.Error(), "shutdown") {
+		t.Errorf("publish after shutdown got error %v, want an ErrClosed on shutdown", err)
+	}
+	_, err = client.PublishAtLeastOnce([]byte("x2"), "t")
+	if !errors.Is(err, mqtt.ErrClosed) || !strings.Contains(err.Error(), "shutdown") {
+		t.Errorf("publish at least once after shutdown got error %v, want an ErrClosed on shutdown", err)
+	}
+}
+
+func TestShutdownQuit(t *testing.T) {
+	client, conn := newClientPipe(t)
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "320700017480007831")
+	})
+	exchange, err := client.PublishAtLeastOnce([]byte("x1"), "t")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	<-brokerMockDone
+
+	quit := make(chan struct{})
+	close(quit)
+	err = client.Shutdown(quit)
+	if !errors.Is(err, mqtt.ErrCanceled) {
+		t.Errorf("shutdown without PUBACK got error %v, want an ErrCanceled", err)
+	}
+	if err := <-exchange; !errors.Is(err, mqtt.ErrClosed) {
+		t.Errorf("exchange got error %v, want an ErrClosed", err)
+	}
+}
+
+func TestReadTopicFilters(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	})
+	_, err = client.ReadWithOptions(mqtt.ReadOptions{Timeout: time.Second / 8})
+	<-brokerMockDone
+	if err != mqtt.ErrReadTimeout {
+		t.Fatal("connect error:", err)
+	}
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "82126000"+"0003612f2b00"+"0003612f2300"+"00016200")
+		sendPacketHex(t, brokerEnd, "90056000000080")     // SUBACK
+		sendPacketHex(t, brokerEnd, "30070003612f786869") // PUBLISH
+	})
+	subscribeDone := testRoutine(t, func() {
+		var failed mqtt.SubscribeError
+		err := client.SubscribeLimitAtMostOnce(nil, "a/+", "a/#", "b")
+		if !errors.As(err, &failed) || len(failed) != 1 || failed[0] != "b" {
+			t.Errorf("subscribe got error %v, want SubscribeError for \"b\" only", err)
+		}
+	})
+	in, err := client.ReadWithOptions(mqtt.ReadOptions{TopicFilters: true})
+	<-brokerMockDone
+	<-subscribeDone
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(in.Message) != "hi" || string(in.Topic) != "a/x" {
+		t.Errorf("got message %q @ %q, want \"hi\" @ \"a/x\"", in.Message, in.Topic)
+	}
+	if filters := in.TopicFilters; len(filters) != 2 || filters[0] != "a/#" || filters[1] != "a/+" {
+		t.Errorf("got topic filters %q, want [\"a/#\" \"a/+\"]", filters)
+	}
+}
+
+func TestReadInbound(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000")       // CONNACK
+		sendPacketHex(t, brokerEnd, "31050001746869") // PUBLISH retained
+		// PUBLISH “at least once” as a duplicate
+		sendPacketHex(t, brokerEnd, "3a070001740001"+"6869")
+		wantPacketHex(t, brokerEnd, "40020001") // PUBACK
+	})
+
+	for _, want := range []mqtt.MessageInfo{
+		{Retained: true},
+		{QoS: 1, Duplicate: true, PacketID: 1},
+	} {
+		in, err := client.ReadWithOptions(mqtt.ReadOptions{})
+		if err != nil {
+			t.Fatal("read error:", err)
+		}
+		if string(in.Message) != "hi" || string(in.Topic) != "t" {
+			t.Errorf("got message %q @ %q, want \"hi\" @ \"t\"", in.Message, in.Topic)
+		}
+		if in.MessageInfo != want {
+			t.Errorf("got info %+v, want %+v", in.MessageInfo, want)
+		}
+	}
+
+	readDone := testRoutine(t, func() {
+		_, err := client.ReadWithOptions(mqtt.ReadOptions{})
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("read got error %v, want an mqtt.ErrClosed", err)
+		}
+	})
+	<-brokerMockDone
+	client.Close()
+	<-readDone
+}
+
+func TestExactlyOnceComplete(t *testing.T) {
+	t.Parallel()
+
+	completeQ := make(chan uint, 1)
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:          time.Second / 4,
+		Dialer:                newTestDialer(t, clientEnd),
+		DropRetained:          time.Second,
+		OnExactlyOnceComplete: func(packetID uint) { completeQ <- packetID },
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd, "82066000"+"00017402")
+		sendPacketHex(t, brokerEnd, "9003600002") // SUBACK
+		// retained PUBLISH “exactly once” gets dropped
+		sendPacketHex(t, brokerEnd, "3507000174"+"0001"+"6869")
+		wantPacketHex(t, brokerEnd, "50020001") // PUBREC
+		sendPacketHex(t, brokerEnd, "62020001") // PUBREL
+		wantPacketHex(t, brokerEnd, "70020001") // PUBCOMP
+		// PUBLISH “exactly once”
+		sendPacketHex(t, brokerEnd, "3407000174"+"0002"+"6869")
+		wantPacketHex(t, brokerEnd, "50020002") // PUBREC
+		sendPacketHex(t, brokerEnd, "62020002") // PUBREL
+		wantPacketHex(t, brokerEnd, "70020002") // PUBCOMP
+	})
+	subscribeDone := testRoutine(t, func() {
+		if err := client.Subscribe(nil, "t"); err != nil {
+			t.Error("subscribe error:", err)
+		}
+	})
+	in, err := client.ReadWithOptions(mqtt.ReadOptions{})
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	<-subscribeDone
+	if in.PacketID != 2 {
+		t.Errorf("got packet identifier %d, want 2", in.PacketID)
+	}
+	select {
+	case packetID := <-completeQ:
+		t.Fatalf("complete hook invoked with %d before PUBREC of 2", packetID)
+	default:
+		break
+	}
+
+	readDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("ReadSlices got error %v, want an mqtt.ErrClosed", err)
+		}
+	})
+	<-brokerMockDone
+	// hook follows the PUBCOMP write within the read routine
+	if packetID := <-completeQ; packetID != 2 {
+		t.Errorf("complete hook got packet identifier %d, want 2", packetID)
+	}
+	client.Close()
+	<-readDone
+}
+
+func TestReadCopy(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		sendPacketHex(t, brokerEnd, hex.EncodeToString([]byte{
+			0x30, 6,
+			0, 1, 'x',
+			'o', 'n', 'e'}))
+		sendPacketHex(t, brokerEnd, hex.EncodeToString([]byte{
+			0x30, 6,
+			0, 1, 'y',
+			't', 'w', 'o'}))
+	})
+	defer func() { <-brokerMockDone }()
+
+	in1, err := client.ReadWithOptions(mqtt.ReadOptions{Copy: true})
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	in2, err := client.ReadWithOptions(mqtt.ReadOptions{Copy: true})
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(in1.Message) != "one" || string(in1.Topic) != "x" {
+		t.Errorf("first read got %q @ %q after the second read, want \"one\" @ \"x\"", in1.Message, in1.Topic)
+	}
+	if string(in2.Message) != "two" || string(in2.Topic) != "y" {
+		t.Errorf("second read got %q @ %q, want \"two\" @ \"y\"", in2.Message, in2.Topic)
+	}
+}
+
+// The read variants are shorthands for ReadWithOptions.
+func TestReadVariants(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000")         // CONNACK
+		sendPacketHex(t, brokerEnd, "300400016131")     // PUBLISH
+		sendPacketHex(t, brokerEnd, "310400016132")     // PUBLISH retained
+		sendPacketHex(t, brokerEnd, "300400016133")     // PUBLISH
+		sendPacketHex(t, brokerEnd, "3006000161223422") // PUBLISH JSON
+		sendPacketHex(t, brokerEnd, "300400016135")     // PUBLISH
+	})
+	defer func() { <-brokerMockDone }()
+
+	message, topic, err := client.ReadSlicesTimeout(time.Second)
+	if err != nil {
+		t.Fatal("ReadSlicesTimeout error:", err)
+	}
+	if string(message) != "1" || string(topic) != "a" {
+		t.Errorf("ReadSlicesTimeout got %q @ %q, want \"1\" @ \"a\"", message, topic)
+	}
+
+	message, topic, info, err := client.ReadSlicesInfo()
+	if err != nil {
+		t.Fatal("ReadSlicesInfo error:", err)
+	}
+	if string(message) != "2" || string(topic) != "a" || info != (mqtt.MessageInfo{Retained: true}) {
+		t.Errorf("ReadSlicesInfo got %q @ %q with %+v, want retained \"2\" @ \"a\"", message, topic, info)
+	}
+
+	message, topicString, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage error:", err)
+	}
+	if string(message) != "3" || topicString != "a" {
+		t.Errorf("ReadMessage got %q @ %q, want \"3\" @ \"a\"", message, topicString)
+	}
+
+	var v string
+	topicString, err = client.ReadDecode(&v, json.Unmarshal)
+	if err != nil {
+		t.Fatal("ReadDecode error:", err)
+	}
+	if v != "4" || topicString != "a" {
+		t.Errorf("ReadDecode got %q @ %q, want \"4\" @ \"a\"", v, topicString)
+	}
+
+	message, topic, filters, err := client.ReadSlicesFilters()
+	if err != nil {
+		t.Fatal("ReadSlicesFilters error:", err)
+	}
+	if string(message) != "5" || string(topic) != "a" || len(filters) != 0 {
+		t.Errorf("ReadSlicesFilters got %q @ %q with %q, want \"5\" @ \"a\" without subscriptions", message, topic, filters)
+	}
+}
+
+func TestReadOptionsDecode(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		sendPacketHex(t, brokerEnd, hex.EncodeToString([]byte{
+			0x30, 17,
+			0, 1, 'x',
+			'{', '"', 'n', 'a', 'm', 'e', '"', ':', '"', 'y', 'e', 's', '"', '}'}))
+		sendPacketHex(t, brokerEnd, hex.EncodeToString([]byte{
+			0x30, 5,
+			0, 1, 'x',
+			'{', '"'}))
+	})
+	defer func() { <-brokerMockDone }()
+
+	var v struct{ Name string }
+	o := mqtt.ReadOptions{Decode: func(message []byte) error {
+		return json.Unmarshal(message, &v)
+	}}
+	in, err := client.ReadWithOptions(o)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(in.Topic) != "x" || v.Name != "yes" {
+		t.Errorf("got %+v @ %q, want {Name:yes} @ \"x\"", v, in.Topic)
+	}
+
+	in, err = client.ReadWithOptions(o)
+	var decodeErr *mqtt.DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("read on malformed JSON got error %v, want a DecodeError", err)
+	}
+	if string(in.Topic) != "x" || decodeErr.Topic != "x" {
+		t.Errorf("got topic %q and DecodeError topic %q, want \"x\"", in.Topic, decodeErr.Topic)
+	}
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Errorf("got error %v, want a wrapped json.SyntaxError", err)
+	}
+}
+
+func TestDropRetained(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		DropRetained: time.Second,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd, "82086000"+"0003612f2301")
+		sendPacketHex(t, brokerEnd, "9003600001")               // SUBACK
+		sendPacketHex(t, brokerEnd, "330a0003612f6200016f6c64") // retained PUBLISH
+		wantPacketHex(t, brokerEnd, "40020001")                 // PUBACK
+		sendPacketHex(t, brokerEnd, "30080003612f626e6577")     // PUBLISH
+	})
+	subscribeDone := testRoutine(t, func() {
+		err := client.SubscribeLimitAtLeastOnce(nil, "a/#")
+		if err != nil {
+			t.Error("subscribe error:", err)
+		}
+	})
+	message, topic, err := client.ReadSlices()
+	<-brokerMockDone
+	<-subscribeDone
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	if string(message) != "new" || string(topic) != "a/b" {
+		t.Errorf("got message %q @ %q, want \"new\" @ \"a/b\"", message, topic)
+	}
+}
+
+func TestDropRetainedHoldTimeout(t *testing.T) {
+	t.Parallel()
+
+	warns := make(chan error, 2)
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		DropRetained: time.Second,
+		HoldTimeout:  time.Second / 16,
+		Warn:         func(err error) { warns <- err },
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd, "82086000"+"0003612f2302")
+		sendPacketHex(t, brokerEnd, "9003600002")               // SUBACK
+		sendPacketHex(t, brokerEnd, "350a0003612f6200016f6c64") // retained PUBLISH
+		wantPacketHex(t, brokerEnd, "50020001")                 // PUBREC
+		sendPacketHex(t, brokerEnd, "340a0003612f6200026e6577") // PUBLISH
+	})
+	subscribeDone := testRoutine(t, func() {
+		err := client.Subscribe(nil, "a/#")
+		if err != nil {
+			t.Error("subscribe error:", err)
+		}
+	})
+	message, topic, err := client.ReadSlices()
+	<-brokerMockDone
+	<-subscribeDone
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	if string(message) != "new" || string(topic) != "a/b" {
+		t.Errorf("got message %q @ %q, want \"new\" @ \"a/b\"", message, topic)
+	}
+
+	// The hold timer of the dropped message was armed first. A leak would
+	// fire before the one of the message on hold.
+	select {
+	case err := <-warns:
+		if !strings.Contains(err.Error(), "0x0002") {
+			t.Error("got warning for other than the message on hold:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no warning on HoldTimeout expiry")
+	}
+
+	readRoutineDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("ReadSlices got error %q, want an ErrClosed", err)
+		}
+	})
+	wantPacketHex(t, brokerEnd, "50020002") // PUBREC
+	if err := client.Close(); err != nil {
+		t.Error("Close error:", err)
+	}
+	<-readRoutineDone
+	if len(warns) != 0 {
+		t.Error("got warning for dropped message:", <-warns)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	var got []string
+	router := mqtt.NewRouter(client)
+	router.HandleFunc("a/+", func(topic string, message []byte) {
+		got = append(got, "a/+ "+topic+" "+string(message))
+	})
+	router.HandleFunc("a/#", func(topic string, message []byte) {
+		got = append(got, "a/# "+topic+" "+string(message))
+	})
+	router.Default = func(topic string, message []byte) {
+		got = append(got, "default "+topic+" "+string(message))
+		client.Close()
+	}
+	router.Error = func(err error) {
+		t.Error("router got error:", err)
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000")             // CONNACK
+		sendPacketHex(t, brokerEnd, "30060003612f7831")     // PUBLISH a/x
+		sendPacketHex(t, brokerEnd, "30080005612f782f7932") // PUBLISH a/x/y
+		sendPacketHex(t, brokerEnd, "300400016333")         // PUBLISH c
+	})
+	routerDone := testRoutine(t, router.Run)
+	<-brokerMockDone
+	select {
+	case <-routerDone:
+		break
+	case <-time.After(time.Second):
+		t.Fatal("router did not stop on close")
+	}
+
+	want := []string{"a/+ a/x 1", "a/# a/x 1", "a/# a/x/y 2", "default c 3"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got, want)
+			break
+		}
+	}
+}
+
+func TestRouterPredicate(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	var got []string
+	router := mqtt.NewRouter(client)
+	router.HandleFuncIf("a/+", func(topic string, message []byte) bool {
+		return bytes.HasPrefix(message, []byte("y"))
+	}, func(topic string, message []byte) {
+		got = append(got, topic+" "+string(message))
+	})
+	router.Default = func(topic string, message []byte) {
+		got = append(got, "default "+topic+" "+string(message))
+		client.Close()
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000")           // CONNACK
+		sendPacketHex(t, brokerEnd, "30070003612f787931") // PUBLISH a/x y1
+		sendPacketHex(t, brokerEnd, "30070003612f786e32") // PUBLISH a/x n2
+		sendPacketHex(t, brokerEnd, "30070003612f787933") // PUBLISH a/x y3
+		sendPacketHex(t, brokerEnd, "30070003612f786e34") // PUBLISH a/x n4
+		sendPacketHex(t, brokerEnd, "3004000163ff")       // PUBLISH c
+	})
+	routerDone := testRoutine(t, router.Run)
+	<-brokerMockDone
+	<-routerDone
+
+	want := []string{"a/x y1", "a/x y3", "default c \xff"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got, want)
+			break
+		}
+	}
+}
+
+func TestRouterSubscribeScoped(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	router := mqtt.NewRouter(client)
+	router.Default = func(topic string, message []byte) {
+		t.Errorf("default got %q @ %q", message, topic)
+	}
+	routerDone := testRoutine(t, router.Run)
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd, "82066000"+"00017401")
+		sendPacketHex(t, brokerEnd, "9003600001")     // SUBACK
+		sendPacketHex(t, brokerEnd, "30050001746869") // PUBLISH t
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, err := router.SubscribeScoped(ctx, "t", 1)
+	if err != nil {
+		t.Fatal("SubscribeScoped error:", err)
+	}
+	select {
+	case m := <-messages:
+		if m.Topic != "t" || string(m.Message) != "hi" {
+			t.Errorf("got message %q @ %q, want \"hi\" @ \"t\"", m.Message, m.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message on the scoped subscription")
+	}
+	<-brokerMockDone
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "a2054001000174") // UNSUBSCRIBE
+		sendPacketHex(t, brokerEnd, "b0024001")       // UNSUBACK
+	})
+	cancel()
+	select {
+	case m, ok := <-messages:
+		if ok {
+			t.Errorf("got message %q @ %q after cancel", m.Message, m.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed on cancel")
+	}
+	<-brokerMockDone
+
+	client.Close()
+	<-routerDone
+}
+
+func TestRouterBackoff(t *testing.T) {
+	t.Parallel()
+
+	dialTimes := make(chan time.Time, 2)
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer: func(context.Context) (net.Conn, error) {
+			select {
+			case dialTimes <- time.Now():
+			default:
+			}
+			return nil, errors.New("broker unavailable")
+		},
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+
+	router := mqtt.NewRouter(client) // without Error
+	routerDone := testRoutine(t, router.Run)
+	first, second := <-dialTimes, <-dialTimes
+	if d := second.Sub(first); d < time.Second {
+		t.Errorf("router redialed after %s, want one second of backoff", d)
+	}
+	client.Close()
+	<-routerDone
+}
+
+func TestReadFraming(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	const bufSize = 128 * 1024 // read buffer capacity
+	fill := make([]byte, 0, bufSize+5)
+	fill = append(fill, 0x30, 0x80, 0x80, 0x08, 0, 1, 'a')
+	fill = append(fill, make([]byte, bufSize-3)...)
+	over := make([]byte, 0, bufSize+6)
+	over = append(over, 0x30, 0x81, 0x80, 0x08, 0, 1, 'b')
+	over = append(over, make([]byte, bufSize-2)...)
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd, "c000")     // PINGREQ
+		// PINGRESP and PUBLISH one byte at a time
+		for _, b := range []byte{0xd0, 0x00, 0x30, 0x03, 0x00, 0x01, 'x'} {
+			time.Sleep(time.Millisecond)
+			if _, err := brokerEnd.Write([]byte{b}); err != nil {
+				t.Error("broker write error:", err)
+				return
+			}
+		}
+		// PUBLISH which fills the read buffer exactly
+		if _, err := brokerEnd.Write(fill); err != nil {
+			t.Error("broker write error:", err)
+			return
+		}
+		// PUBLISH which exceeds the read buffer by one byte
+		if _, err := brokerEnd.Write(over); err != nil {
+			t.Error("broker write error:", err)
+			return
+		}
+	})
+	defer func() { <-brokerMockDone }()
+
+	pingDone := testRoutine(t, func() {
+		if err := client.Ping(nil); err != nil {
+			t.Error("ping error:", err)
+		}
+	})
+	message, topic, err := client.ReadSlices()
+	<-pingDone
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	if len(message) != 0 || string(topic) != "x" {
+		t.Errorf("got message %q @ %q, want \"\" @ \"x\"", message, topic)
+	}
+
+	message, topic, err = client.ReadSlices()
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	if len(message) != bufSize-3 || string(topic) != "a" {
+		t.Errorf("got %d byte message @ %q, want %d bytes @ \"a\"", len(message), topic, bufSize-3)
+	}
+
+	_, _, err = client.ReadSlices()
+	var big *mqtt.BigMessage
+	if !errors.As(err, &big) {
+		t.Fatalf("ReadSlices got error %v, want a BigMessage", err)
+	}
+	message, err = big.ReadAll()
+	if err != nil {
+		t.Fatal("BigMessage ReadAll error:", err)
+	}
+	if len(message) != bufSize-2 || big.Topic != "b" {
+		t.Errorf("got %d byte message @ %q, want %d bytes @ \"b\"", len(message), big.Topic, bufSize-2)
+	}
+}
+
+func TestBigMessageRead(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	const size = 200 * 1024 // exceeds read buffer
+	big := make([]byte, 0, size+7)
+	// remaining length of 3 + size
+	big = append(big, 0x30, 0x83, 0xc0, 0x0c, 0, 1, 'b')
+	for i := 0; i < size; i++ {
+		big = append(big, byte(i))
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		for i := 0; i < 2; i++ {
+			if _, err := brokerEnd.Write(big); err != nil {
+				t.Error("broker write error:", err)
+				return
+			}
+		}
+		sendPacketHex(t, brokerEnd, "300400017831") // PUBLISH
+		sendPacketHex(t, brokerEnd, "300400017832") // PUBLISH
+	})
+	defer func() { <-brokerMockDone }()
+
+	// stream in full
+	_, _, err = client.ReadSlices()
+	var bigMessage *mqtt.BigMessage
+	if !errors.As(err, &bigMessage) {
+		t.Fatalf("ReadSlices got error %v, want a BigMessage", err)
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyBuffer(&buf, struct{ io.Reader }{bigMessage}, make([]byte, 1000))
+	if err != nil {
+		t.Fatal("BigMessage read error:", err)
+	}
+	if n != size || !bytes.Equal(buf.Bytes(), big[7:]) {
+		t.Errorf("got %d bytes streamed, want %d bytes from the PUBLISH", n, size)
+	}
+
+	// stream in part
+	_, _, err = client.ReadSlices()
+	if !errors.As(err, &bigMessage) {
+		t.Fatalf("ReadSlices got error %v, want a BigMessage", err)
+	}
+	part := make([]byte, 10)
+	if _, err := io.ReadFull(bigMessage, part); err != nil {
+		t.Fatal("BigMessage read error:", err)
+	}
+	if !bytes.Equal(part, big[7:17]) {
+		t.Errorf("got first bytes %#x, want %#x", part, big[7:17])
+	}
+
+	// remainder skipped
+	for _, want := range []string{"1", "2"} {
+		message, topic, err := client.ReadSlices()
+		if err != nil {
+			t.Fatal("ReadSlices error:", err)
+		}
+		if string(message) != want || string(topic) != "x" {
+			t.Errorf("got message %q @ %q, want %q @ \"x\"", message, topic, want)
+		}
+	}
+	if _, err := bigMessage.Read(part); err == nil {
+		t.Error("BigMessage read after ReadSlices got no error")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       mqtt.NewWebSocketDialer("ws://"+ln.Addr().String()+"/mqtt", nil),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client, mqtttest.Transfer{Message: []byte("hi"), Topic: "t"})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		t.Fatal("broker got HTTP request error:", err)
+	}
+	if req.URL.Path != "/mqtt" || req.Header.Get("Sec-WebSocket-Protocol") != "mqtt" {
+		t.Errorf("broker got request for %q with subprotocol %q, want \"/mqtt\" with \"mqtt\"", req.URL.Path, req.Header.Get("Sec-WebSocket-Protocol"))
+	}
+	sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(sum[:])+"\r\n"+
+		"Sec-WebSocket-Protocol: mqtt\r\n\r\n")
+	if err != nil {
+		t.Fatal("broker write error:", err)
+	}
+
+	// ReadFrame returns the payload of a client frame.
+	readFrame := func() (opcode byte, payload []byte) {
+		t.Helper()
+		var head [6]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			t.Fatal("broker read error:", err)
+		}
+		if head[1]&0x80 == 0 {
+			t.Fatal("broker got frame without mask")
+		}
+		payload = make([]byte, head[1]&0x7f)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatal("broker read error:", err)
+		}
+		for i := range payload {
+			payload[i] ^= head[2+i&3]
+		}
+		return head[0] & 0xf, payload
+	}
+
+	var connect []byte
+	for len(connect) < len(pipeCONNECTHex)/2 {
+		opcode, payload := readFrame()
+		if opcode != 2 {
+			t.Fatalf("broker got opcode %#x, want binary", opcode)
+		}
+		connect = append(connect, payload...)
+	}
+	if got := hex.EncodeToString(connect); got != pipeCONNECTHex {
+		t.Errorf("broker got CONNECT %s, want %s", got, pipeCONNECTHex)
+	}
+
+	// CONNACK, a PUBLISH spread over a continuation, and a ping
+	_, err = conn.Write([]byte{
+		0x82, 4, 0x20, 2, 0, 0,
+		0x02, 3, 0x30, 5, 0,
+		0x80, 4, 1, 't', 'h', 'i',
+		0x89, 1, 'p',
+	})
+	if err != nil {
+		t.Fatal("broker write error:", err)
+	}
+	if opcode, payload := readFrame(); opcode != 0xa || string(payload) != "p" {
+		t.Errorf("broker got opcode %#x with payload %q, want a pong with \"p\"", opcode, payload)
+	}
+}
+
+func TestWouldReceive(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	if client.WouldReceive("a/b") {
+		t.Error("WouldReceive before subscribe got true")
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd, "820e6000"+"00032b2f6200"+"0003632f2300")
+		sendPacketHex(t, brokerEnd, "900460000000")       // SUBACK
+		sendPacketHex(t, brokerEnd, "30070003612f626869") // PUBLISH
+	})
+	subscribeDone := testRoutine(t, func() {
+		<-client.Online()
+		err := client.SubscribeLimitAtMostOnce(nil, "+/b", "c/#")
+		if err != nil {
+			t.Error("subscribe error:", err)
+		}
+	})
+	_, _, err = client.ReadSlices()
+	<-brokerMockDone
+	<-subscribeDone
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+
+	for topic, want := range map[string]bool{
+		"a/b":    true,
+		"/b":     true,
+		"c":      true,
+		"c/d/e":  true,
+		"a/c":    false,
+		"a/b/c":  false,
+		"d":      false,
+		"$SYS/b": false,
+		"$c/d":   false,
+	} {
+		if got := client.WouldReceive(topic); got != want {
+			t.Errorf("WouldReceive(%q) got %t, want %t", topic, got, want)
+		}
+	}
+}
+
+func TestResubscribe(t *testing.T) {
+	t.Parallel()
+
+	clientEnd1, brokerEnd1 := net.Pipe()
+	clientEnd2, brokerEnd2 := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd1, clientEnd2),
+		Warn:         func(err error) { t.Error("warning:", err) },
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd1, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd1, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd1, "82086000"+"0003612f2b01")
+		sendPacketHex(t, brokerEnd1, "9003600001") // SUBACK
+		brokerEnd1.Close()
+	})
+	subscribeDone := testRoutine(t, func() {
+		err := client.SubscribeLimitAtLeastOnce(nil, "a/+")
+		if err != nil {
+			t.Error("subscribe error:", err)
+		}
+	})
+	_, _, err = client.ReadSlices()
+	<-brokerMockDone
+	<-subscribeDone
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("ReadSlices got error %v, want an io.EOF", err)
+	}
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd2, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd2, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd2, "82086001"+"0003612f2b01")
+		sendPacketHex(t, brokerEnd2, "9003600101")         // SUBACK
+		sendPacketHex(t, brokerEnd2, "30070003612f626869") // PUBLISH
+	})
+	message, topic, err := client.ReadSlices()
+	<-brokerMockDone
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	if string(message) != "hi" || string(topic) != "a/b" {
+		t.Errorf("got message %q @ %q, want \"hi\" @ \"a/b\"", message, topic)
+	}
+}
+
+func TestSessionPresent(t *testing.T) {
+	t.Parallel()
+
+	clientEnd1, brokerEnd1 := net.Pipe()
+	clientEnd2, brokerEnd2 := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd1, clientEnd2),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd1, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd1, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd1, "82086000"+"0003612f2b01")
+		sendPacketHex(t, brokerEnd1, "9003600001") // SUBACK
+		brokerEnd1.Close()
+	})
+	subscribeDone := testRoutine(t, func() {
+		err := client.SubscribeLimitAtLeastOnce(nil, "a/+")
+		if err != nil {
+			t.Error("subscribe error:", err)
+		}
+	})
+	_, _, err = client.ReadSlices()
+	<-brokerMockDone
+	<-subscribeDone
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("ReadSlices got error %v, want an io.EOF", err)
+	}
+	if client.SessionPresent() {
+		t.Error("session present after CONNACK without the flag")
+	}
+
+	// no resubscribe on session present
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd2, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd2, "20020100")           // CONNACK
+		sendPacketHex(t, brokerEnd2, "30070003612f626869") // PUBLISH
+		wantPacketHex(t, brokerEnd2, "c000")               // PINGREQ
+		sendPacketHex(t, brokerEnd2, "d000")               // PINGRESP
+	})
+	_, _, err = client.ReadSlices()
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	if !client.SessionPresent() {
+		t.Error("no session present after CONNACK with the flag")
+	}
+	readDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("ReadSlices got error %v, want mqtt.ErrClosed", err)
+		}
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Error("ping error:", err)
+	}
+	<-brokerMockDone
+	client.Close()
+	<-readDone
+}
+
+// MQTT 5.0 sessions need an expiry interval to survive the connection.
+func TestSessionPresent5(t *testing.T) {
+	t.Parallel()
+
+	clientEnd1, brokerEnd1 := net.Pipe()
+	clientEnd2, brokerEnd2 := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ProtocolLevel:  5,
+		AtLeastOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd1, clientEnd2),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client, mqtttest.Transfer{Err: io.EOF})
+
+	wantPacketHex(t, brokerEnd1, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	sendPacketHex(t, brokerEnd1, "2003000000") // CONNACK
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd1, "82096000"+"00"+"0003612f2b01")
+		sendPacketHex(t, brokerEnd1, "900460000001") // SUBACK
+		wantPacketHex(t, brokerEnd1, "3207000174"+"8000"+"00"+"31")
+		brokerEnd1.Close()
+	})
+	if err := client.SubscribeLimitAtLeastOnce(nil, "a/+"); err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+	exchange, err := client.PublishAtLeastOnce([]byte("1"), "t")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	<-brokerMockDone
+
+	// no resubscribe on session present, and resend with DUP flag
+	wantPacketHex(t, brokerEnd2, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	sendPacketHex(t, brokerEnd2, "2003010000") // CONNACK
+	wantPacketHex(t, brokerEnd2, "3a07000174"+"8000"+"00"+"31")
+	sendPacketHex(t, brokerEnd2, "40028000") // PUBACK
+	if err := <-exchange; !errors.Is(err, mqtt.ErrDown) {
+		t.Errorf("exchange got error %v, want an ErrDown on the connection loss", err)
+	}
+	testAck(t, exchange)
+	if !client.SessionPresent() {
+		t.Error("no session present after CONNACK with the flag")
+	}
+}
+
+func TestBrokerTerm(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF})
+	<-client.Online()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[0], "320700017480007831")
+	})
+	exchange, err := client.PublishAtLeastOnce([]byte("x1"), "t")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	<-brokerMockDone
+
+	// broker terminates without DISCONNECT
+	if err := conns[0].Close(); err != nil {
+		t.Fatal("broker mock got error on pipe close:", err)
+	}
+	select {
+	case <-client.Offline():
+		break // OK
+	case <-time.After(time.Second):
+		t.Fatal("offline signal timeout after broker termination")
+	}
+	// notified before any reconnect
+	if err := <-exchange; !errors.Is(err, mqtt.ErrDown) {
+		t.Errorf("exchange got error %v, want an ErrDown", err)
+	}
+
+	// recovers on next ReadSlices
+	wantPacketHex(t, conns[1], pipeCONNECTHex)
+	sendPacketHex(t, conns[1], "20020000") // CONNACK
+	select {
+	case <-client.Online():
+		break // OK
+	case <-time.After(time.Second):
+		t.Fatal("online signal timeout after reconnect")
+	}
+
+	// resumes on new connection
+	wantPacketHex(t, conns[1], "3a0700017480007831") // with DUP flag
+	sendPacketHex(t, conns[1], "40028000")           // PUBACK
+	if err, ok := <-exchange; ok {
+		t.Errorf("exchange got error %v after PUBACK, want a closed channel", err)
+	}
+}
+
+// A slow transfer must not expire PauseTimeout, as long as bytes keep coming.
+func TestPauseTimeoutTrickle(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	timeouts := make(chan struct{}, 1)
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, timeoutConn{clientEnd, timeouts}),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client, mqtttest.Transfer{Message: []byte("hi"), Topic: "x"})
+	wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+
+	// fixed header one byte at a time
+	for _, b := range []byte{0x30, 5} {
+		if _, err := brokerEnd.Write([]byte{b}); err != nil {
+			t.Fatal("broker mock write error:", err)
+		}
+	}
+	// payload one byte at a time, with a read timeout in between
+	payload := []byte{0, 1, 'x', 'h', 'i'}
+	for i, b := range payload {
+		if _, err := brokerEnd.Write([]byte{b}); err != nil {
+			t.Fatal("broker mock write error:", err)
+		}
+		if i == len(payload)-1 {
+			break // packet complete
+		}
+		// expire the pending read of the next byte
+		if err := clientEnd.SetReadDeadline(time.Now()); err != nil {
+			t.Fatal("read deadline error:", err)
+		}
+		<-timeouts
+	}
+}
+
+func TestPauseTimeoutStall(t *testing.T) {
+	_, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: os.ErrDeadlineExceeded})
+
+	// PUBLISH with only the topic name
+	sendPacketHex(t, conns[0], "3005000178")
+
+	// reconnect after stall
+	wantPacketHex(t, conns[1], pipeCONNECTHex)
+	sendPacketHex(t, conns[1], "20020000") // CONNACK
+}
+
+// Zero PauseTimeout disables deadlines entirely.
+func TestPauseTimeoutZero(t *testing.T) {
+	t.Parallel()
+
+	clientConn, conn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		Dialer: newTestDialer(t, noDeadlineConn{clientConn, t, false}),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client, mqtttest.Transfer{Message: []byte("hi"), Topic: "x"})
+	wantPacketHex(t, conn, pipeCONNECTHex)
+	sendPacketHex(t, conn, "20020000") // CONNACK
+
+	for _, b := range []byte{0x30, 5, 0, 1, 'x', 'h', 'i'} {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			t.Fatal("broker mock write error:", err)
+		}
+	}
+}
+
+// Negative ReadPauseTimeout disables deadlines on read only.
+func TestReadPauseTimeoutDisable(t *testing.T) {
+	t.Parallel()
+
+	clientConn, conn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:     time.Second / 16,
+		ReadPauseTimeout: -1,
+		Dialer:           newTestDialer(t, noDeadlineConn{clientConn, t, true}),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client, mqtttest.Transfer{Message: []byte("hi"), Topic: "x"})
+	wantPacketHex(t, conn, pipeCONNECTHex)
+	sendPacketHex(t, conn, "20020000") // CONNACK
+
+	// PUBLISH in two parts
+	sendPacketHex(t, conn, "3005000178")
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal("broker mock write error:", err)
+	}
+}
+
+// TimeoutConn signals each read timeout.
+type timeoutConn struct {
+	net.Conn
+	timeouts chan<- struct{}
+}
+
+func (c timeoutConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.timeouts <- struct{}{}
+	}
+	return n, err
+}
+
+// NoDeadlineConn fails the test on read deadlines, and optionally on write
+// deadlines too.
+type noDeadlineConn struct {
+	net.Conn
+	t       *testing.T
+	writeOK bool
+}
+
+func (c noDeadlineConn) SetDeadline(t time.Time) error {
+	if !t.IsZero() {
+		c.t.Errorf("got deadline %s, want none", t)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c noDeadlineConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		c.t.Errorf("got read deadline %s, want none", t)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c noDeadlineConn) SetWriteDeadline(t time.Time) error {
+	if !t.IsZero() && !c.writeOK {
+		c.t.Errorf("got write deadline %s, want none", t)
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func TestSetWill(t *testing.T) {
+	t.Parallel()
+
+	clientEnd1, brokerEnd1 := net.Pipe()
+	clientEnd2, brokerEnd2 := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd1, clientEnd2),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	will := &mqtt.Will{Topic: "x", Message: []byte("bye")}
+	if err := client.SetWill(&mqtt.Will{Message: []byte("bye")}); !mqtt.IsDeny(err) {
+		t.Errorf("SetWill without topic got error %v, want an IsDeny", err)
+	}
+
+	termBroker := make(chan struct{})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd1, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd1, "20020000") // CONNACK
+		<-termBroker
+		brokerEnd1.Close()
+	})
+	readRoutineDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("ReadSlices got error %q, want an io.EOF", err)
+		}
+	})
+	<-client.Online()
+	if err := client.SetWill(will); err == nil {
+		t.Error("SetWill while online got no error")
+	}
+	close(termBroker)
+	<-brokerMockDone
+	<-readRoutineDone
+
+	if err := client.SetWill(will); err != nil {
+		t.Fatal("SetWill while offline got error:", err)
+	}
+	readRoutineDone = testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("ReadSlices got error %q, want an ErrClosed", err)
+		}
+	})
+	wantPacketHex(t, brokerEnd2, "101400044d5154540404000000000001780003627965")
+	sendPacketHex(t, brokerEnd2, "20020000") // CONNACK
+	<-client.Online()
+	if err := client.Close(); err != nil {
+		t.Error("Close error:", err)
+	}
+	<-readRoutineDone
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	t.Parallel()
+
+	clientEnd1, brokerEnd1 := net.Pipe()
+	clientEnd2, brokerEnd2 := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:       time.Second / 4,
+		MaxSessionDuration: time.Second / 8,
+		Dialer:             newTestDialer(t, clientEnd1, clientEnd2),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+
+	wantPacketHex(t, brokerEnd1, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd1, "20020000") // CONNACK
+	connectTime := time.Now()
+	wantPacketHex(t, brokerEnd1, "e000") // DISCONNECT
+	if d := time.Since(connectTime); d < time.Second/8 {
+		t.Errorf("DISCONNECT after %s, want MaxSessionDuration of 125ms", d)
+	}
+
+	wantPacketHex(t, brokerEnd2, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd2, "20020000") // CONNACK
+	<-client.Online()
+}
+
 func TestReceivePublishAtLeastOnce(t *testing.T) {
 	_, conn := newClientPipe(t, mqtttest.Transfer{Message: []byte("hello"), Topic: "greet"})
 
-	sendPacketHex(t, conn, hex.EncodeToString([]byte{
-		0x32, 14,
-		0, 5, 'g', 'r', 'e', 'e', 't',
-		0xab, 0xcd, // packet identifier
-		'h', 'e', 'l', 'l', 'o'}))
-	wantPacketHex(t, conn, "4002abcd") // PUBACK
+	sendPacketHex(t, conn, hex.EncodeToString([]byte{
+		0x32, 14,
+		0, 5, 'g', 'r', 'e', 'e', 't',
+		0xab, 0xcd, // packet identifier
+		'h', 'e', 'l', 'l', 'o'}))
+	wantPacketHex(t, conn, "4002abcd") // PUBACK
+}
+
+// Acknowledgements from the read routine must not interleave with concurrent
+// publications on the connection.
+func TestReceivePublishAtLeastOnceConcurrent(t *testing.T) {
+	const receiveN, publishN = 4, 16
+	want := make([]mqtttest.Transfer, receiveN)
+	for i := range want {
+		want[i] = mqtttest.Transfer{Message: []byte("hello"), Topic: "greet"}
+	}
+	client, conn := newClientPipe(t, want...)
+
+	brokerMockDone := testRoutine(t, func() {
+		const publishHex = "300c0005677265657468656c6c6f"
+		var gotPublishN int
+		gotAcks := make(map[string]bool)
+		var buf [128]byte
+		for gotPublishN < publishN || len(gotAcks) < receiveN {
+			_, err := io.ReadFull(conn, buf[:2])
+			if err != nil {
+				t.Error("broker read error:", err)
+				return
+			}
+			if buf[1] > 126 {
+				t.Errorf("packet %#x… too big for test", buf[:2])
+				return
+			}
+			n, err := io.ReadFull(conn, buf[2:2+buf[1]])
+			if err != nil {
+				t.Errorf("broker read error %q after %#x", err, buf[:2+n])
+				return
+			}
+			switch got := hex.EncodeToString(buf[:2+n]); {
+			case got == publishHex:
+				gotPublishN++
+			case strings.HasPrefix(got, "4002") && len(got) == 8:
+				gotAcks[got] = true
+			default:
+				t.Errorf("broker got packet 0x%s, want either 0x%s or a PUBACK", got, publishHex)
+				return
+			}
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < publishN/4; j++ {
+				if err := client.Publish(nil, []byte("hello"), "greet"); err != nil {
+					t.Error("publish error:", err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < receiveN; i++ {
+		sendPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0xab, byte(i), // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+	}
+	wg.Wait()
+	<-brokerMockDone
+}
+
+func TestReceivePublishExactlyOnce(t *testing.T) {
+	_, conn := newClientPipe(t, mqtttest.Transfer{Message: []byte("hello"), Topic: "greet"})
+
+	// write PUBLISH
+	sendPacketHex(t, conn, hex.EncodeToString([]byte{
+		0x34, 14,
+		0, 5, 'g', 'r', 'e', 'e', 't',
+		0xab, 0xcd, // packet identifier
+		'h', 'e', 'l', 'l', 'o'}))
+	wantPacketHex(t, conn, "5002abcd") // PUBREC
+	sendPacketHex(t, conn, "6002abcd") // PUBREL
+	wantPacketHex(t, conn, "7002abcd") // PUBCOMP
+}
+
+// The exactly-once confirmation must wait for the next ReadSlices, such that the
+// consumer can process each message before ownership is acknowledged.
+func TestReceivePublishExactlyOnceHold(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		sendPacketHex(t, brokerEnd, hex.EncodeToString([]byte{
+			0x34, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0xab, 0xcd, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+	})
+	message, topic, err := client.ReadSlices()
+	if err != nil {
+		t.Fatal("ReadSlices got error:", err)
+	}
+	if string(message) != "hello" || string(topic) != "greet" {
+		t.Errorf("got message %q @ %q, want \"hello\" @ \"greet\"", message, topic)
+	}
+	<-brokerMockDone
+
+	// processing of message in progress
+	brokerEnd.SetReadDeadline(time.Now().Add(time.Second / 8))
+	var buf [1]byte
+	n, err := brokerEnd.Read(buf[:])
+	var e net.Error
+	if !errors.As(err, &e) || !e.Timeout() {
+		t.Errorf("broker got %#x with error %q before next ReadSlices, want a Timeout net.Error", buf[:n], err)
+	}
+	brokerEnd.SetReadDeadline(time.Time{})
+
+	readRoutineDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("ReadSlices got error %q, want an ErrClosed", err)
+		}
+	})
+	wantPacketHex(t, brokerEnd, "5002abcd") // PUBREC
+	if err := client.Close(); err != nil {
+		t.Error("Close error:", err)
+	}
+	<-readRoutineDone
+}
+
+func TestReceivePublishExactlyOnceHoldTimeout(t *testing.T) {
+	t.Parallel()
+
+	warns := make(chan error, 2)
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		HoldTimeout:  time.Second / 16,
+		Warn:         func(err error) { warns <- err },
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		sendPacketHex(t, brokerEnd, hex.EncodeToString([]byte{
+			0x34, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0xab, 0xcd, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+	})
+	if _, _, err := client.ReadSlices(); err != nil {
+		t.Fatal("ReadSlices got error:", err)
+	}
+	<-brokerMockDone
+
+	// processing of message exceeds HoldTimeout
+	select {
+	case err := <-warns:
+		t.Log("got warning:", err)
+	case <-time.After(time.Second):
+		t.Fatal("no warning on HoldTimeout expiry")
+	}
+
+	readRoutineDone := testRoutine(t, func() {
+		_, _, err := client.ReadSlices()
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("ReadSlices got error %q, want an ErrClosed", err)
+		}
+	})
+	wantPacketHex(t, brokerEnd, "5002abcd") // PUBREC
+	if err := client.Close(); err != nil {
+		t.Error("Close error:", err)
+	}
+	<-readRoutineDone
+	if len(warns) != 0 {
+		t.Errorf("got %d more warnings, want 1 in total", len(warns))
+	}
 }
 
-func TestReceivePublishExactlyOnce(t *testing.T) {
-	_, conn := newClientPipe(t, mqtttest.Transfer{Message: []byte("hello"), Topic: "greet"})
+func TestStatsTransfer(t *testing.T) {
+	t.Parallel()
 
-	// write PUBLISH
-	sendPacketHex(t, conn, hex.EncodeToString([]byte{
-		0x34, 14,
-		0, 5, 'g', 'r', 'e', 'e', 't',
-		0xab, 0xcd, // packet identifier
-		'h', 'e', 'l', 'l', 'o'}))
-	wantPacketHex(t, conn, "5002abcd") // PUBREC
-	sendPacketHex(t, conn, "6002abcd") // PUBREL
-	wantPacketHex(t, conn, "7002abcd") // PUBCOMP
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd, "300c0005677265657468656c6c6f")
+		sendPacketHex(t, brokerEnd, "3004000178ff")
+	})
+	publishDone := testRoutine(t, func() {
+		<-client.Online()
+		if err := client.Publish(nil, []byte("hello"), "greet"); err != nil {
+			t.Error("publish error:", err)
+		}
+	})
+	if _, _, err := client.ReadSlices(); err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	<-brokerMockDone
+	<-publishDone
+
+	got := client.Stats()
+	if got.ReceiveN != 1 || got.ReceiveBytes != 1 {
+		t.Errorf("got %d messages received with %d bytes, want 1 and 1", got.ReceiveN, got.ReceiveBytes)
+	}
+	if got.PublishN != 1 || got.PublishBytes != 5 {
+		t.Errorf("got %d messages published with %d bytes, want 1 and 5", got.PublishN, got.PublishBytes)
+	}
+}
+
+func TestStatsPacketSizes(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000")          // CONNACK
+		sendPacketHex(t, brokerEnd, "d000")              // PINGRESP
+		sendPacketHex(t, brokerEnd, "300500017468"+"69") // PUBLISH
+		sendPacketHex(t, brokerEnd, "3067000174"+strings.Repeat("41", 100))
+	})
+	// the read routine counts each packet before return
+	for i := 0; i < 2; i++ {
+		if _, _, err := client.ReadSlices(); err != nil {
+			t.Fatal("ReadSlices error:", err)
+		}
+	}
+	<-brokerMockDone
+
+	got := client.Stats().PacketSizes
+	// PINGRESP and the small PUBLISH, plus the large PUBLISH
+	want := [8]uint64{2, 0, 1}
+	if got != want {
+		t.Errorf("got packet sizes %d, want %d", got, want)
+	}
+}
+
+type packetLog struct {
+	sync.Mutex
+	reads, writes []string
+}
+
+func (l *packetLog) OnPacketRead(kind byte, size int) {
+	l.Lock()
+	defer l.Unlock()
+	l.reads = append(l.reads, fmt.Sprintf("%d:%d", kind, size))
+}
+
+func (l *packetLog) OnPacketWrite(kind byte, size int) {
+	l.Lock()
+	defer l.Unlock()
+	l.writes = append(l.writes, fmt.Sprintf("%d:%d", kind, size))
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	var metrics packetLog
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+		Metrics:      &metrics,
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+		sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+		wantPacketHex(t, brokerEnd, "300c0005677265657468656c6c6f")
+		sendPacketHex(t, brokerEnd, "3004000178ff")
+	})
+	publishDone := testRoutine(t, func() {
+		<-client.Online()
+		if err := client.Publish(nil, []byte("hello"), "greet"); err != nil {
+			t.Error("publish error:", err)
+		}
+	})
+	if _, _, err := client.ReadSlices(); err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	<-brokerMockDone
+	<-publishDone
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if got, want := strings.Join(metrics.reads, " "), "2:4 3:6"; got != want {
+		t.Errorf("got reads %q, want %q", got, want)
+	}
+	if got, want := strings.Join(metrics.writes, " "), "1:14 3:14"; got != want {
+		t.Errorf("got writes %q, want %q", got, want)
+	}
+}
+
+func TestPacketIDHooks(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	var reserved, freed []uint
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		AtLeastOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd),
+		OnReserve: func(packetID uint) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			reserved = append(reserved, packetID)
+		},
+		OnFree: func(packetID uint) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			freed = append(freed, packetID)
+		},
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	<-client.Online()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "3207000178800068"+"69")
+		sendPacketHex(t, brokerEnd, "40028000") // PUBACK
+	})
+	exchange, err := client.PublishAtLeastOnce([]byte("hi"), "x")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	<-brokerMockDone
+	testAck(t, exchange)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(reserved) != 1 || reserved[0] != 0x8000 {
+		t.Errorf("got reserves %#x, want [0x8000]", reserved)
+	}
+	if len(freed) != 1 || freed[0] != 0x8000 {
+		t.Errorf("got frees %#x, want [0x8000]", freed)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		io.Copy(io.Discard, conn)
+	})
+	defer func() {
+		client.Close()
+		<-brokerMockDone
+	}()
+
+	const publishN = 100
+	publishDone := testRoutine(t, func() {
+		for i := 0; i < publishN; i++ {
+			if err := client.Publish(nil, []byte("x"), "t"); err != nil {
+				t.Error("publish error:", err)
+				return
+			}
+		}
+	})
+	for i := 0; i < 10; i++ {
+		client.ResetStats()
+		got := client.Stats()
+		if got.PublishN > publishN || got.PublishBytes > publishN {
+			t.Errorf("got %d messages published with %d bytes after reset, want %d at most", got.PublishN, got.PublishBytes, publishN)
+		}
+	}
+	<-publishDone
+
+	client.ResetStats()
+	if got := client.Stats(); got.PublishN != 0 || got.PublishBytes != 0 {
+		t.Errorf("got %d messages published with %d bytes after reset, want none", got.PublishN, got.PublishBytes)
+	}
+	if err := client.Publish(nil, []byte("hello"), "t"); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	if got := client.Stats(); got.PublishN != 1 || got.PublishBytes != 5 {
+		t.Errorf("got %d messages published with %d bytes, want 1 and 5", got.PublishN, got.PublishBytes)
+	}
 }
 
 func TestReceivePublishAtLeastOnceBig(t *testing.T) {
@@ -494,3 +3105,280 @@ func typeLabelFromHex(char byte) string {
 		panic("not a hex character")
 	}
 }
+
+func TestStrictTLSDialer(t *testing.T) {
+	cert, roots := newTestCert(t)
+
+	t.Run("TLS1.0", func(t *testing.T) {
+		addr := newTLSListener(t, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS10,
+			MaxVersion:   tls.VersionTLS10,
+		})
+		dial := mqtt.NewStrictTLSDialer("tcp", addr, &tls.Config{RootCAs: roots}, tls.VersionTLS12)
+		conn, err := dial(context.Background())
+		if err == nil {
+			conn.Close()
+			t.Fatal("dial to TLS 1.0 broker got no error")
+		}
+		// either end may detect the mismatch first
+		if !strings.Contains(err.Error(), "protocol version") {
+			t.Errorf("dial to TLS 1.0 broker got error %q, want a protocol version failure", err)
+		}
+	})
+
+	t.Run("TLS1.2", func(t *testing.T) {
+		addr := newTLSListener(t, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			MaxVersion:   tls.VersionTLS12,
+		})
+		dial := mqtt.NewStrictTLSDialer("tcp", addr, &tls.Config{RootCAs: roots}, tls.VersionTLS12)
+		conn, err := dial(context.Background())
+		if err != nil {
+			t.Fatal("dial to TLS 1.2 broker got error:", err)
+		}
+		conn.Close()
+	})
+}
+
+// NewTestCert returns a self-signed certificate for 127.0.0.1.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mqtt test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+// NewTLSListener returns the address of a listener which performs a handshake
+// on each connection, and then closes the connection.
+func newTLSListener(t *testing.T, config *tls.Config) (addr string) {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestConnDialer(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       mqtt.NewConnDialer(clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, pipeCONNECTHex)
+		sendPacketHex(t, brokerConn, "20020000") // CONNACK
+		if err := brokerConn.Close(); err != nil {
+			t.Error("broker mock got error on pipe close:", err)
+		}
+	})
+	_, _, err = client.ReadSlices()
+	if err == nil || errors.Is(err, mqtt.ErrClosed) {
+		t.Fatalf("ReadSlices got error %v, want connection loss", err)
+	}
+	<-brokerMockDone
+
+	_, _, err = client.ReadSlices()
+	if !errors.Is(err, mqtt.ErrConnUsed) {
+		t.Errorf("ReadSlices after connection loss got error %v, want mqtt.ErrConnUsed", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Error("close error:", err)
+	}
+	_, _, err = client.ReadSlices()
+	if !errors.Is(err, mqtt.ErrClosed) {
+		t.Errorf("ReadSlices after close got error %v, want mqtt.ErrClosed", err)
+	}
+}
+
+func TestUnixDialer(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("no Unix domain sockets:", err)
+	}
+	defer ln.Close()
+
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       mqtt.NewDialer("unix", path),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client, mqtttest.Transfer{Message: []byte("hi"), Topic: "t"})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("accept error:", err)
+	}
+	defer conn.Close()
+	wantPacketHex(t, conn, pipeCONNECTHex)
+	sendPacketHex(t, conn, "20020000")       // CONNACK
+	sendPacketHex(t, conn, "30050001746869") // PUBLISH
+
+	// PINGRESP comes after the PUBLISH got read
+	pingDone := testRoutine(t, func() {
+		if err := client.Ping(nil); err != nil {
+			t.Error("ping error:", err)
+		}
+	})
+	wantPacketHex(t, conn, "c000") // PINGREQ
+	sendPacketHex(t, conn, "d000") // PINGRESP
+	<-pingDone
+}
+
+// ProxyFunc implements mqtt.ProxyDialer.
+type proxyFunc func(network, address string) (net.Conn, error)
+
+func (f proxyFunc) Dial(network, address string) (net.Conn, error) {
+	return f(network, address)
+}
+
+func TestProxyDialer(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	defer brokerConn.Close()
+	proxy := proxyFunc(func(network, address string) (net.Conn, error) {
+		if network != "tcp" || address != "broker.example:1883" {
+			t.Errorf("proxy got %q %q, want tcp broker.example:1883", network, address)
+		}
+		return clientConn, nil
+	})
+	dial := mqtt.NewProxyDialer("tcp", "broker.example:1883", proxy)
+	conn, err := dial(context.Background())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	if conn != clientConn {
+		t.Errorf("dial got %v, want connection from proxy", conn)
+	}
+
+	t.Run("abandon", func(t *testing.T) {
+		block := make(chan struct{})
+		defer close(block)
+		dial := mqtt.NewProxyDialer("tcp", "broker.example:1883", proxyFunc(func(network, address string) (net.Conn, error) {
+			<-block
+			return nil, errors.New("proxy unblocked")
+		}))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second/16)
+		defer cancel()
+		_, err := dial(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("dial got error %v, want context.DeadlineExceeded", err)
+		}
+	})
+}
+
+func TestProxyTLSDialer(t *testing.T) {
+	cert, roots := newTestCert(t)
+	addr := newTLSListener(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	var proxyN int
+	proxy := proxyFunc(func(network, address string) (net.Conn, error) {
+		proxyN++
+		return net.Dial(network, address)
+	})
+	dial := mqtt.NewProxyTLSDialer("tcp", addr, proxy, &tls.Config{RootCAs: roots})
+	conn, err := dial(context.Background())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	conn.Close()
+	if proxyN != 1 {
+		t.Errorf("got %d proxy invocations, want 1", proxyN)
+	}
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("dial got a %T, want a *tls.Conn", conn)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	// accept TCP, yet stall on TLS
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // hold until listener close
+		}
+	}()
+	addr := l.Addr().String()
+
+	dialers := map[string]mqtt.Dialer{
+		"TLS":   mqtt.NewTLSDialer("tcp", addr, nil),
+		"proxy": mqtt.NewProxyTLSDialer("tcp", addr, proxyFunc(net.Dial), nil),
+	}
+	for name, dial := range dialers {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second/8)
+		start := time.Now()
+		conn, err := dial(ctx)
+		cancel()
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s dial got no error on stalled handshake", name)
+			continue
+		}
+		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%s dial got error %q [%T], want a deadline exceeded", name, err, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s dial took %s", name, d)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -39,6 +40,42 @@ func init() {
 		subscribeFlags = append(subscribeFlags, value)
 		return nil
 	})
+	flag.Func("subscribe-file", "Listen with the topic filters from a `file`, one per line, like\n"+bold+"-subscribe"+clear+". Blank lines and lines which start with \"# \" are\nignored.", func(value string) error {
+		filters, err := readFilters(value)
+		if err != nil {
+			return err
+		}
+		subscribeFlags = append(subscribeFlags, filters...)
+		return nil
+	})
+}
+
+// ReadFilters parses a topic-filter file.
+func readFilters(path string) ([]string, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var filters, invalid []string
+	for i, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if err := mqtt.ValidateTopicFilter(line); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s:%d: %q: %s", path, i+1, line, err))
+			continue
+		}
+		filters = append(filters, line)
+	}
+	if len(invalid) != 0 {
+		return nil, errors.New(strings.Join(invalid, "\n"))
+	}
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("%s: no topic filters", path)
+	}
+	return filters, nil
 }
 
 const generatedLabel = "generated"
@@ -65,6 +102,8 @@ var (
 	topicFlag  = flag.Bool("topic", false, "Print the respective topic of each inbound message.")
 	quoteFlag  = flag.Bool("quote", false, "Print inbound topics and messages as quoted strings.")
 
+	statsFlag = flag.Bool("stats", false, "Print a transfer summary to "+italic+"standard error"+clear+" on exit.")
+
 	quietFlag   = flag.Bool("quiet", false, "Suppress all output to "+italic+"standard error"+clear+". Error reporting is\ndeduced to the exit code only.")
 	verboseFlag = flag.Bool("verbose", false, "Produces more output to "+italic+"standard error"+clear+" for debug purposes.")
 )
@@ -166,15 +205,17 @@ func Config() (clientID string, config *mqtt.Config) {
 		addr = net.JoinHostPort(addr, port)
 	}
 
-	clientID = *clientFlag
-	if clientID == generatedLabel {
-		clientID = "mqttc(1)-" + time.Now().In(time.UTC).Format(time.RFC3339Nano)
-	}
-
 	config = &mqtt.Config{
 		PauseTimeout: *timeoutFlag,
 		UserName:     *userFlag,
 	}
+	clientID = *clientFlag
+	if clientID == generatedLabel {
+		clientID = ""
+		config.ClientIDGenerator = func() string {
+			return "mqttc(1)-" + time.Now().In(time.UTC).Format(time.RFC3339Nano)
+		}
+	}
 	if *passFlag != "" {
 		bytes, err := os.ReadFile(*passFlag)
 		if err != nil {
@@ -234,7 +275,7 @@ func main() {
 			printMessage(message, topic)
 
 		case errors.Is(err, mqtt.ErrClosed):
-			os.Exit(<-exitStatus)
+			exit(client, <-exitStatus)
 
 		case errors.As(err, &big):
 			message, err := big.ReadAll()
@@ -247,22 +288,40 @@ func main() {
 		default:
 			failMQTT(client, err)
 
+			var refused *mqtt.ConnectRefused
+			if errors.As(err, &refused) {
+				log.Printf("%s: CONNACK return code %d", name, refused.Code)
+			}
 			switch {
 			case errors.Is(err, mqtt.ErrProtocolLevel):
-				os.Exit(5)
+				exit(client, 5)
 			case errors.Is(err, mqtt.ErrClientID):
-				os.Exit(6)
+				exit(client, 6)
 			case errors.Is(err, mqtt.ErrUnavailable):
-				os.Exit(7)
+				exit(client, 7)
 			case errors.Is(err, mqtt.ErrAuthBad):
-				os.Exit(8)
+				exit(client, 8)
 			case errors.Is(err, mqtt.ErrAuth):
-				os.Exit(9)
+				exit(client, 9)
 			}
 		}
 	}
 }
 
+// Exit terminates the process with a transfer summary, if requested.
+func exit(client *mqtt.Client, status int) {
+	if *statsFlag {
+		log.Print(statsLine(client.Stats()))
+	}
+	os.Exit(status)
+}
+
+// StatsLine returns the transfer summary.
+func statsLine(stats mqtt.Stats) string {
+	return fmt.Sprintf("%s: received %d messages with %d bytes, published %d messages with %d bytes",
+		name, stats.ReceiveN, stats.ReceiveBytes, stats.PublishN, stats.PublishBytes)
+}
+
 func printMessage(message, topic interface{}) {
 	switch {
 	case *topicFlag && *quoteFlag:
@@ -282,9 +341,11 @@ func execPubSub(client *mqtt.Client) {
 		message, err := io.ReadAll(io.LimitReader(os.Stdin, messageMax))
 		switch {
 		case err != nil:
-			log.Fatal(name, ": ", err)
+			failMQTT(client, fmt.Errorf("%s: %w", name, err))
+			return
 		case len(message) >= messageMax:
-			log.Fatalf("%s: standard input reached %d byte limit", name, messageMax)
+			failMQTT(client, fmt.Errorf("%s: standard input reached %d byte limit", name, messageMax))
+			return
 		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), *timeoutFlag)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-mqtt/mqtt"
+)
+
+func TestReadFilters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+	const text = `# comment
+a/+
+
+  b/#
+c
+`
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFilters(path)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if want := []string{"a/+", "b/#", "c"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got filters %q, want %q", got, want)
+	}
+}
+
+func TestReadFiltersInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+	if err := os.WriteFile(path, []byte("a/+\na/#/b\nc+\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readFilters(path)
+	if err == nil {
+		t.Fatal("read got no error")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], path+":2: ") || !strings.HasPrefix(lines[1], path+":3: ") {
+		t.Errorf("got error %q, want line 2 and 3 reported", err)
+	}
+}
+
+func TestReadFiltersNone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+	if err := os.WriteFile(path, []byte("# none\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFilters(path); err == nil {
+		t.Error("read without filters got no error")
+	}
+}
+
+func TestStatsLine(t *testing.T) {
+	got := statsLine(mqtt.Stats{ReceiveN: 2, ReceiveBytes: 99, PublishN: 1, PublishBytes: 7})
+	want := name + ": received 2 messages with 99 bytes, published 1 messages with 7 bytes"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -19,6 +19,9 @@
 // before network submission. Errors imply that the message was dropped: either
 // ErrClosed, ErrMax, Save failure and an IsDeny. Further errors are reported to
 // the respective exchange channel. None of them are fatal, including ErrClosed.
+//
+// The quit channel on requests aborts with ErrCanceled once closed. A Done from
+// context.Context fits as is, e.g., client.Publish(ctx.Done(), message, topic).
 package mqtt
 
 import (
@@ -29,6 +32,7 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
@@ -94,6 +98,10 @@ var (
 	errNull = errors.New("string contains null character")
 
 	errStringZero = errors.New("string is empty")
+
+	errTopicWildcard  = errors.New("topic name contains wildcard")
+	errFilterWildcard = errors.New("topic filter wildcard not on a level of its own")
+	errFilterHash     = errors.New("topic filter with multi-level wildcard not at the end")
 )
 
 // Validation errors are expected to be prefixed according to the context.
@@ -129,6 +137,124 @@ func topicCheck(s string) error {
 	return stringCheck(s)
 }
 
+// “The wildcard characters can be used in Topic Filters, but MUST NOT be used
+// within a Topic Name.”
+// — MQTT Version 3.1.1, conformance statement MQTT-4.7.1-1
+func topicNameCheck(s string) error {
+	if strings.ContainsAny(s, "+#") {
+		return errTopicWildcard
+	}
+	return topicCheck(s)
+}
+
+func topicFilterCheck(s string) error {
+	// seek wildcards only, as filters can be large
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		// “The multi-level wildcard character MUST be specified
+		// either on its own or following a topic level separator.
+		// In either case it MUST be the last character specified
+		// in the Topic Filter.”
+		// — MQTT Version 3.1.1, conformance statement MQTT-4.7.1-2
+		if i != 0 && s[i-1] != '/' {
+			return errFilterWildcard
+		}
+		if i != len(s)-1 {
+			return errFilterHash
+		}
+	}
+	for offset := 0; ; {
+		i := strings.IndexByte(s[offset:], '+')
+		if i < 0 {
+			break
+		}
+		i += offset
+		offset = i + 1
+
+		// “The single-level wildcard can be used at any level in
+		// the Topic Filter, including first and last levels. Where
+		// it is used it MUST occupy an entire level of the filter.”
+		// — MQTT Version 3.1.1, conformance statement MQTT-4.7.1-3
+		if (i != 0 && s[i-1] != '/') || (i != len(s)-1 && s[i+1] != '/') {
+			return errFilterWildcard
+		}
+	}
+	return topicCheck(s)
+}
+
+// ValidateTopicName returns an error when name is not a legal topic name for
+// publication. Any error matches IsDeny.
+func ValidateTopicName(name string) error {
+	if err := topicNameCheck(name); err != nil {
+		return fmt.Errorf("mqtt: illegal topic name %q: %w", name, err)
+	}
+	return nil
+}
+
+// ValidateTopicFilter returns an error when filter is not a legal topic filter
+// for subscription. Any error matches IsDeny.
+func ValidateTopicFilter(filter string) error {
+	if err := topicFilterCheck(filter); err != nil {
+		return fmt.Errorf("mqtt: illegal topic filter %q: %w", filter, err)
+	}
+	return nil
+}
+
+// TopicMatch returns whether topic matches filter, conform the wildcard rules
+// from MQTT 3.1.1, subsection 4.7.1. Brokers route messages on the same rules.
+// Topic filters starting with a wildcard do not match topics which start with a
+// '$' character, like “$SYS/uptime”.
+func TopicMatch(filter, topic string) bool {
+	// “The Server MUST NOT match Topic Filters starting with a wildcard
+	// character (# or +) with Topic Names beginning with a $ character.”
+	// — MQTT Version 3.1.1, conformance statement MQTT-4.7.2-1
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "#") || strings.HasPrefix(filter, "+")) {
+		return false
+	}
+
+	for {
+		filterLevel, topicLevel := filter, topic
+		i := strings.IndexByte(filter, '/')
+		if i >= 0 {
+			filterLevel = filter[:i]
+		}
+		if filterLevel == "#" {
+			return true
+		}
+		j := strings.IndexByte(topic, '/')
+		if j >= 0 {
+			topicLevel = topic[:j]
+		}
+		if filterLevel != "+" && filterLevel != topicLevel {
+			return false
+		}
+
+		switch {
+		case i < 0:
+			return j < 0
+		case j < 0:
+			// “sport/#” also matches the singular “sport”
+			return filter[i+1:] == "#"
+		}
+		filter, topic = filter[i+1:], topic[j+1:]
+	}
+}
+
+// BuildTopic joins levels into a topic name. Levels with a separator ('/') or
+// a wildcard ('+' or '#') are denied, which makes it safe to use untrusted
+// input.
+func BuildTopic(levels ...string) (string, error) {
+	for _, level := range levels {
+		if i := strings.IndexAny(level, "/+#"); i >= 0 {
+			return "", fmt.Errorf("mqtt: topic level %q contains %q", level, level[i])
+		}
+	}
+	topic := strings.Join(levels, "/")
+	if err := topicCheck(topic); err != nil {
+		return "", fmt.Errorf("mqtt: illegal topic: %w", err)
+	}
+	return topic, nil
+}
+
 // IsDeny returns whether execution was rejected by the Client based on some
 // validation constraint, like size limitation or an illegal UTF-8 encoding.
 // The rejection is permanent in such case. Another invocation with the same
@@ -136,7 +262,7 @@ func topicCheck(s string) error {
 func IsDeny(err error) bool {
 	for err != nil {
 		switch err {
-		case errPacketMax, errStringMax, errUTF8, errNull, errStringZero, errSubscribeNone, errUnsubscribeNone:
+		case errPacketMax, errStringMax, errUTF8, errNull, errStringZero, errTopicWildcard, errFilterWildcard, errFilterHash, errSubscribeNone, errUnsubscribeNone, errSubscribeLevels, errSubscribeLevel, errRetainHandling, errSubscribeOptions, errPublishOptions:
 			return true
 		}
 		err = errors.Unwrap(err)
@@ -148,7 +274,10 @@ func IsDeny(err error) bool {
 type connectReturn byte
 
 // Connect return errors are predefined reasons for a broker to deny a connect
-// request. IsConnectionRefused returns true for each of these.
+// request. IsConnectionRefused returns true for each of these. The constant
+// values equal their return code from CONNACK, i.e., 1 for ErrProtocolLevel up
+// to 5 for ErrAuth. Any ConnectRefused matches its respective constant with
+// errors.Is.
 const (
 	accepted connectReturn = iota
 
@@ -194,6 +323,46 @@ func (code connectReturn) Error() string {
 	}
 }
 
+// ConnectRefused is the error from a CONNACK with a non-zero return code, or a
+// reason code of 0x80 or more with MQTT version 5.0. Unwrap provides the
+// respective connect return error, like ErrAuthBad.
+type ConnectRefused struct {
+	Code   byte   // connect return code or reason code
+	Reason string // optional description from the broker
+}
+
+// Error implements the standard error interface.
+func (e *ConnectRefused) Error() string {
+	var s string
+	if e.Code < 0x80 {
+		s = connectReturn(e.Code).Error()
+	} else {
+		s = fmt.Sprintf("mqtt: connection refused: reason code %#02x", e.Code)
+	}
+	if e.Reason == "" {
+		return s
+	}
+	return s + "; " + e.Reason
+}
+
+// Unwrap returns the connect return error for the code. The reason codes from
+// MQTT version 5.0 map to their MQTT version 3.1.1 counterpart, if any.
+func (e *ConnectRefused) Unwrap() error {
+	switch e.Code {
+	case 0x84: // Unsupported Protocol Version
+		return ErrProtocolLevel
+	case 0x85: // Client Identifier not valid
+		return ErrClientID
+	case 0x88, 0x89: // Server unavailable, Server busy
+		return ErrUnavailable
+	case 0x86: // Bad User Name or Password
+		return ErrAuthBad
+	case 0x87: // Not authorized
+		return ErrAuth
+	}
+	return connectReturn(e.Code)
+}
+
 // IsConnectionRefused returns whether the broker denied a connect request from
 // the Client.
 func IsConnectionRefused(err error) bool {
@@ -386,6 +555,55 @@ func (dir fileSystem) List() (keys []uint, err error) {
 	return keys, nil
 }
 
+// MigratePersistence copies a session from one Persistence to another, e.g.,
+// before a switch to FileSystem, such that AdoptSession can continue with the
+// pending exchanges on the destination. Neither may be in use by a Client. The
+// destination must be empty. The client identifier is copied last, which makes
+// an incomplete migration fail on adoption. Values are copied as is, with
+// their integrity checks intact.
+func MigratePersistence(from, to Persistence) error {
+	keys, err := to.List()
+	if err != nil {
+		return err
+	}
+	if len(keys) != 0 {
+		return errors.New("mqtt: migrate to non-empty persistence")
+	}
+	keys, err = from.List()
+	if err != nil {
+		return err
+	}
+
+	var hasClientID bool
+	for _, key := range keys {
+		if key == clientIDKey {
+			hasClientID = true
+			continue
+		}
+		if err := migrateKey(from, to, key); err != nil {
+			return err
+		}
+	}
+	if !hasClientID {
+		return errors.New("mqtt: migrate from persistence without client identifier")
+	}
+	return migrateKey(from, to, clientIDKey)
+}
+
+func migrateKey(from, to Persistence, key uint) error {
+	value, err := from.Load(key)
+	switch {
+	case err != nil:
+		return err
+	case value == nil:
+		return nil // deleted in mean time
+	}
+	if err := to.Save(key, net.Buffers{value}); err != nil {
+		return fmt.Errorf("mqtt: migration of key %#05x: %w", key, err)
+	}
+	return nil
+}
+
 // ruggedPersistence applies a sequence number plus integrity checks to a
 // delegate.
 type ruggedPersistence struct {
@@ -1,12 +1,15 @@
 package mqtt
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"net"
+	"os"
 	"sort"
 	"testing"
+	"time"
 )
 
 func TestConstants(t *testing.T) {
@@ -18,6 +21,73 @@ func TestConstants(t *testing.T) {
 	}
 }
 
+func TestBuildTopic(t *testing.T) {
+	got, err := BuildTopic("sensor", "kitchen", "", "temp")
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	if want := "sensor/kitchen//temp"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, level := range []string{"a/b", "+", "a#", "/"} {
+		got, err := BuildTopic("sensor", level)
+		if err == nil {
+			t.Errorf("level %q got topic %q, want error", level, got)
+		}
+	}
+	if got, err := BuildTopic(); !errors.Is(err, errStringZero) {
+		t.Errorf("no levels got topic %q with error %v, want errStringZero", got, err)
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	for name, want := range map[string]error{
+		"a":      nil,
+		"/":      nil,
+		"$SYS/x": nil,
+		"":       errStringZero,
+		"a\x00b": errNull,
+		"a/+":    errTopicWildcard,
+		"#":      errTopicWildcard,
+	} {
+		err := ValidateTopicName(name)
+		if !errors.Is(err, want) || (want == nil) != (err == nil) {
+			t.Errorf("ValidateTopicName(%q) got error %v, want %v", name, err, want)
+		}
+		if err != nil && !IsDeny(err) {
+			t.Errorf("ValidateTopicName(%q) error %v not IsDeny", name, err)
+		}
+	}
+
+	for filter, want := range map[string]error{
+		"a":       nil,
+		"#":       nil,
+		"+":       nil,
+		"a/#":     nil,
+		"+/+/#":   nil,
+		"/+/":     nil,
+		"$SYS/#":  nil,
+		"":        errStringZero,
+		"a\x00/#": errNull,
+		"a#":      errFilterWildcard,
+		"a/b#":    errFilterWildcard,
+		"#/a":     errFilterHash,
+		"a/#/":    errFilterHash,
+		"a+":      errFilterWildcard,
+		"+a/b":    errFilterWildcard,
+		"a/+b":    errFilterWildcard,
+	} {
+		err := ValidateTopicFilter(filter)
+		if !errors.Is(err, want) || (want == nil) != (err == nil) {
+			t.Errorf("ValidateTopicFilter(%q) got error %v, want %v", filter, err, want)
+		}
+		if err != nil && !IsDeny(err) {
+			t.Errorf("ValidateTopicFilter(%q) error %v not IsDeny", filter, err)
+		}
+	}
+}
+
 func TestNewCONNREQ(t *testing.T) {
 	c := &Config{
 		Dialer: func(context.Context) (net.Conn, error) {
@@ -44,6 +114,185 @@ func TestNewCONNREQ(t *testing.T) {
 	if !bytes.Equal(got, want) {
 		t.Errorf("full session config got %#x, want %#x", got, want)
 	}
+
+	c.ProtocolLevel = 5
+	got = c.newCONNREQ([]byte("#🤖"))
+	want = []byte{0x10, 39, 0, 4, 'M', 'Q', 'T', 'T', 5, 0b1111_0110, 0x0e, 0x10, 0,
+		0, 5, '#', 0xF0, 0x9F, 0xA4, 0x96,
+		0,
+		0, 6, 0xe2, 0x98, 0xaf, 0xef, 0xb8, 0x8f,
+		0, 3, 0xe2, 0x98, 0xa0,
+		0, 2, 'm', 'e',
+		0, 1, '?'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("full session config on protocol level 5 got %#x, want %#x", got, want)
+	}
+
+	c.Will.DelayInterval = 30
+	c.Will.MessageExpiry = 1 << 16
+	c.Will.ContentType = "t"
+	got = c.newCONNREQ([]byte("#🤖"))
+	want = []byte{0x10, 53, 0, 4, 'M', 'Q', 'T', 'T', 5, 0b1111_0110, 0x0e, 0x10, 0,
+		0, 5, '#', 0xF0, 0x9F, 0xA4, 0x96,
+		14, propWillDelay, 0, 0, 0, 30, propMessageExpiry, 0, 1, 0, 0, propContentType, 0, 1, 't',
+		0, 6, 0xe2, 0x98, 0xaf, 0xef, 0xb8, 0x8f,
+		0, 3, 0xe2, 0x98, 0xa0,
+		0, 2, 'm', 'e',
+		0, 1, '?'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("will properties on protocol level 5 got %#x, want %#x", got, want)
+	}
+	if err := c.valid(); err != nil {
+		t.Error("will properties on protocol level 5 got error:", err)
+	}
+	c.ProtocolLevel = 4
+	if err := c.valid(); err == nil {
+		t.Error("will properties on protocol level 4 got no error")
+	}
+}
+
+func TestAppendPublishPacketSize(t *testing.T) {
+	golden := []struct {
+		size int
+		want []byte // remaining length
+	}{
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+	}
+	for _, gold := range golden {
+		message := make([]byte, gold.size-3) // topic "t"
+		var buf [bufSize]byte
+		packet, err := appendPublishPacket(&buf, message, "t", 0, typePUBLISH<<4, nil)
+		if err != nil {
+			t.Errorf("size %d got error: %s", gold.size, err)
+			continue
+		}
+		head := packet[0]
+		want := append(append([]byte{typePUBLISH << 4}, gold.want...), 0, 1, 't')
+		if !bytes.Equal(head, want) {
+			t.Errorf("size %d got head %#x, want %#x", gold.size, head, want)
+		}
+		if size, n := readVarint(head[1:]); size != gold.size || n != len(gold.want) {
+			t.Errorf("size %d decoded as %d in %d bytes", gold.size, size, n)
+		}
+	}
+}
+
+// TimeoutConn fails each Write of more than n bytes with a timeout, after
+// transferring the first n bytes.
+type timeoutConn struct {
+	net.Conn
+	n   int
+	got []byte
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if len(p) <= c.n {
+		c.got = append(c.got, p...)
+		return len(p), nil
+	}
+	c.got = append(c.got, p[:c.n]...)
+	return c.n, timeoutError{}
+}
+
+func (c *timeoutConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestWriteTimeout(t *testing.T) {
+	// progress on each attempt
+	conn := &timeoutConn{n: 1}
+	if err := write(conn, packetPINGREQ, time.Second); err != nil {
+		t.Error("write with progress got error:", err)
+	}
+	if !bytes.Equal(conn.got, packetPINGREQ) {
+		t.Errorf("write with progress got %#x, want %#x", conn.got, packetPINGREQ)
+	}
+
+	// no progress
+	conn = &timeoutConn{n: 0}
+	err := write(conn, packetPINGREQ, time.Second)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("write without progress got error %v, want a timeout", err)
+	}
+}
+
+// A write deadline within a frame must close the connection.
+func TestWebSocketFrameWritePartial(t *testing.T) {
+	conn := &closeConn{timeoutConn: timeoutConn{n: 2 + 4 + 2}}
+	ws := &wsConn{Conn: conn}
+	n, err := ws.Write([]byte("abc"))
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("write got error %v, want a timeout", err)
+	}
+	if n != 2 {
+		t.Errorf("write got %d bytes, want the 2 bytes of payload sent", n)
+	}
+	if !conn.closed {
+		t.Error("connection not closed after partial frame")
+	}
+}
+
+type closeConn struct {
+	timeoutConn
+	closed bool
+}
+
+func (c *closeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// A read deadline must not lose a partially received frame header.
+func TestWebSocketFrameDeadline(t *testing.T) {
+	clientEnd, brokerEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer brokerEnd.Close()
+	ws := &wsConn{Conn: clientEnd, r: bufio.NewReader(clientEnd)}
+
+	proceed := make(chan struct{})
+	brokerDone := make(chan struct{})
+	go func() {
+		defer close(brokerDone)
+		if _, err := brokerEnd.Write([]byte{0x80 | wsBinary}); err != nil {
+			t.Error("broker write error:", err)
+			return
+		}
+		<-proceed
+		if _, err := brokerEnd.Write([]byte{3, 'a', 'b', 'c'}); err != nil {
+			t.Error("broker write error:", err)
+		}
+	}()
+
+	if err := clientEnd.SetReadDeadline(time.Now().Add(time.Second / 16)); err != nil {
+		t.Fatal("set deadline error:", err)
+	}
+	var buf [8]byte
+	n, err := ws.Read(buf[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read with half a header got %d bytes and error %v, want deadline expiry", n, err)
+	}
+	if err := clientEnd.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal("clear deadline error:", err)
+	}
+	close(proceed)
+
+	n, err = ws.Read(buf[:])
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if got := string(buf[:n]); got != "abc" {
+		t.Errorf("got payload %q, want \"abc\"", got)
+	}
+	<-brokerDone
 }
 
 func TestPesistenceEmpty(t *testing.T) {
@@ -207,3 +456,76 @@ func testPersistenceDelete(t *testing.T, p Persistence) {
 		t.Errorf("List got %d, want %d", keys, []uint{99})
 	}
 }
+
+func TestMigratePersistence(t *testing.T) {
+	from := newVolatile()
+	values := map[uint]string{
+		clientIDKey:              "test-client",
+		0x8000:                   "at least once",
+		0xc000:                   "exactly once",
+		0xc001 | remoteIDKeyFlag: "received",
+		0xffff | remoteIDKeyFlag: "last",
+	}
+	for key, value := range values {
+		if err := from.Save(key, net.Buffers{[]byte(value)}); err != nil {
+			t.Fatal("Save error:", err)
+		}
+	}
+
+	to := FileSystem(t.TempDir())
+	if err := MigratePersistence(from, to); err != nil {
+		t.Fatal("MigratePersistence error:", err)
+	}
+	keys, err := to.List()
+	if err != nil {
+		t.Fatal("List error:", err)
+	}
+	if len(keys) != len(values) {
+		t.Errorf("got %d keys after migration, want %d", len(keys), len(values))
+	}
+	for key, want := range values {
+		got, err := to.Load(key)
+		if err != nil {
+			t.Errorf("Load %#05x error: %s", key, err)
+		} else if string(got) != want {
+			t.Errorf("got %q for key %#05x, want %q", got, key, want)
+		}
+	}
+
+	if err := MigratePersistence(from, to); err == nil {
+		t.Error("MigratePersistence to non-empty destination got no error")
+	}
+	if err := MigratePersistence(newVolatile(), newVolatile()); err == nil {
+		t.Error("MigratePersistence without client identifier got no error")
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a", false},
+		{"a/+", "a/", true},
+		{"+/+", "/a", true},
+		{"+", "/a", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+	}
+	for _, test := range tests {
+		if got := TopicMatch(test.filter, test.topic); got != test.want {
+			t.Errorf("topic filter %q with topic %q got %t, want %t", test.filter, test.topic, got, test.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package mqtttest
 import (
 	"bytes"
 	"errors"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -277,3 +278,105 @@ func newSubscribeMock(name string, t testing.TB, want ...Filter) func(quit <-cha
 		return filter.Err
 	}
 }
+
+// Loopback is a broker-less stand-in for mqtt.Client. Publish passes messages
+// to ReadSlices when the topic matches any of the subscribed topic filters.
+// Messages which match no subscription are discarded, like a broker would.
+type Loopback struct {
+	mutex   sync.Mutex
+	filters map[string]struct{}
+
+	queue  chan Transfer
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewLoopback returns a new Loopback which holds up to bufN messages pending
+// ReadSlices. Publish blocks when the buffer is full.
+func NewLoopback(bufN int) *Loopback {
+	return &Loopback{
+		filters: make(map[string]struct{}),
+		queue:   make(chan Transfer, bufN),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Subscribe mocks mqtt.Client Subscribe.
+func (l *Loopback) Subscribe(quit <-chan struct{}, topicFilters ...string) error {
+	if len(topicFilters) == 0 {
+		panic("MQTT subscribe without topic filters")
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, filter := range topicFilters {
+		l.filters[filter] = struct{}{}
+	}
+	return nil
+}
+
+// Unsubscribe mocks mqtt.Client Unsubscribe.
+func (l *Loopback) Unsubscribe(quit <-chan struct{}, topicFilters ...string) error {
+	if len(topicFilters) == 0 {
+		panic("MQTT unsubscribe without topic filters")
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, filter := range topicFilters {
+		delete(l.filters, filter)
+	}
+	return nil
+}
+
+// Publish mocks mqtt.Client Publish.
+func (l *Loopback) Publish(quit <-chan struct{}, message []byte, topic string) error {
+	if !l.match(topic) {
+		return nil
+	}
+
+	// use copy to prevent some hard to trace issues
+	transfer := Transfer{Message: make([]byte, len(message)), Topic: topic}
+	copy(transfer.Message, message)
+
+	select {
+	case <-l.closed:
+		return mqtt.ErrClosed
+	default:
+		break
+	}
+	select {
+	case l.queue <- transfer:
+		return nil
+	case <-l.closed:
+		return mqtt.ErrClosed
+	case <-quit:
+		return mqtt.ErrCanceled
+	}
+}
+
+func (l *Loopback) match(topic string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for filter := range l.filters {
+		if mqtt.TopicMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadSlices mocks mqtt.Client ReadSlices. It blocks until either a message
+// is available, or until Close.
+func (l *Loopback) ReadSlices() (message, topic []byte, err error) {
+	select {
+	case transfer := <-l.queue:
+		return transfer.Message, []byte(transfer.Topic), nil
+	case <-l.closed:
+		return nil, nil, mqtt.ErrClosed
+	}
+}
+
+// Close mocks mqtt.Client Close.
+func (l *Loopback) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
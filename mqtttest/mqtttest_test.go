@@ -1,6 +1,7 @@
 package mqtttest_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/go-mqtt/mqtt"
@@ -35,4 +36,42 @@ func TestSignatureMatch(t *testing.T) {
 	subscribe = mqtttest.NewSubscribeStub(nil)
 	unsubscribe = mqtttest.NewUnsubscribeMock(t)
 	unsubscribe = mqtttest.NewUnsubscribeStub(nil)
+	loopback := mqtttest.NewLoopback(0)
+	subscribe = loopback.Subscribe
+	unsubscribe = loopback.Unsubscribe
+	publish = loopback.Publish
+	readSlices = loopback.ReadSlices
+}
+
+func TestLoopback(t *testing.T) {
+	l := mqtttest.NewLoopback(4)
+	if err := l.Subscribe(nil, "sensor/+/temp", "alarm/#"); err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+
+	for _, topic := range []string{"sensor/kitchen/temp", "sensor/kitchen/humidity", "alarm", "alarm/fire", "$SYS/alarm"} {
+		if err := l.Publish(nil, []byte(topic), topic); err != nil {
+			t.Fatalf("publish to %q got error: %s", topic, err)
+		}
+	}
+	for _, want := range []string{"sensor/kitchen/temp", "alarm", "alarm/fire"} {
+		message, topic, err := l.ReadSlices()
+		if err != nil {
+			t.Fatal("ReadSlices error:", err)
+		}
+		if string(topic) != want || string(message) != want {
+			t.Errorf("got message %q @ %q, want %q @ %q", message, topic, want, want)
+		}
+	}
+
+	if err := l.Unsubscribe(nil, "alarm/#"); err != nil {
+		t.Fatal("unsubscribe error:", err)
+	}
+	if err := l.Publish(nil, []byte("x"), "alarm/fire"); err != nil {
+		t.Fatal("publish after unsubscribe got error:", err)
+	}
+	l.Close()
+	if _, _, err := l.ReadSlices(); !errors.Is(err, mqtt.ErrClosed) {
+		t.Errorf("ReadSlices after Close got error %v, want mqtt.ErrClosed", err)
+	}
 }
@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MQTT 5.0 packets may carry properties. Each property has an identifier,
+// which determines the data type of its value.
+// See MQTT Version 5.0, table 2-4: “Properties”.
+const (
+	propPayloadFormat       = 0x01 // byte
+	propMessageExpiry       = 0x02 // four byte integer
+	propContentType         = 0x03 // UTF-8 string
+	propResponseTopic       = 0x08 // UTF-8 string
+	propCorrelationData     = 0x09 // binary data
+	propSubscriptionID      = 0x0b // variable byte integer
+	propSessionExpiry       = 0x11 // four byte integer
+	propAssignedClientID    = 0x12 // UTF-8 string
+	propServerKeepAlive     = 0x13 // two byte integer
+	propAuthMethod          = 0x15 // UTF-8 string
+	propAuthData            = 0x16 // binary data
+	propRequestProblemInfo  = 0x17 // byte
+	propWillDelay           = 0x18 // four byte integer
+	propRequestResponseInfo = 0x19 // byte
+	propResponseInfo        = 0x1a // UTF-8 string
+	propServerReference     = 0x1c // UTF-8 string
+	propReasonString        = 0x1f // UTF-8 string
+	propReceiveMax          = 0x21 // two byte integer
+	propTopicAliasMax       = 0x22 // two byte integer
+	propTopicAlias          = 0x23 // two byte integer
+	propMaxQOS              = 0x24 // byte
+	propRetainAvailable     = 0x25 // byte
+	propUserProperty        = 0x26 // UTF-8 string pair
+	propMaxPacketSize       = 0x27 // four byte integer
+	propWildcardSubAvail    = 0x28 // byte
+	propSubIDAvail          = 0x29 // byte
+	propSharedSubAvail      = 0x2a // byte
+)
+
+// PropertiesNone is an empty property list.
+var propertiesNone = []byte{0}
+
+// ReadVarint decodes a variable byte integer from the start of p. The size
+// is the number of bytes read, with zero for incomplete or illegal encodings.
+func readVarint(p []byte) (value, size int) {
+	for shift := uint(0); size < len(p) && size < 4; shift += 7 {
+		b := p[size]
+		size++
+		value |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, size
+		}
+	}
+	return 0, 0
+}
+
+// AppendVarint encodes a variable byte integer at the end of p.
+func appendVarint(p []byte, value int) []byte {
+	for ; value > 0x7f; value >>= 7 {
+		p = append(p, byte(value|0x80))
+	}
+	return append(p, byte(value))
+}
+
+// EachProperty walks over a property list, including its length prefix, from
+// the start of p. The value slices exclude any of the length prefixes from
+// strings and binary data. The string pairs of user properties are passed as
+// is. The size is the number of bytes read from p.
+func eachProperty(p []byte, f func(id byte, value []byte)) (size int, err error) {
+	length, n := readVarint(p)
+	if n == 0 || n+length > len(p) {
+		return 0, fmt.Errorf("%w: property length exceeds remaining length", ErrProtocol)
+	}
+	props := p[n:][:length]
+	for len(props) != 0 {
+		id := props[0]
+		props = props[1:]
+
+		var valueSize int
+		switch id {
+		case propPayloadFormat, propRequestProblemInfo, propRequestResponseInfo, propMaxQOS, propRetainAvailable, propWildcardSubAvail, propSubIDAvail, propSharedSubAvail:
+			valueSize = 1
+		case propServerKeepAlive, propReceiveMax, propTopicAliasMax, propTopicAlias:
+			valueSize = 2
+		case propMessageExpiry, propSessionExpiry, propWillDelay, propMaxPacketSize:
+			valueSize = 4
+		case propSubscriptionID:
+			_, valueSize = readVarint(props)
+			if valueSize == 0 {
+				return 0, fmt.Errorf("%w: malformed subscription identifier property", ErrProtocol)
+			}
+		case propContentType, propResponseTopic, propAssignedClientID, propAuthMethod, propResponseInfo, propServerReference, propReasonString, propCorrelationData, propAuthData:
+			if len(props) < 2 {
+				return 0, fmt.Errorf("%w: property %#02x exceeds property length", ErrProtocol, id)
+			}
+			valueSize = 2 + int(binary.BigEndian.Uint16(props))
+		case propUserProperty:
+			if len(props) < 2 {
+				return 0, fmt.Errorf("%w: property %#02x exceeds property length", ErrProtocol, id)
+			}
+			valueSize = 2 + int(binary.BigEndian.Uint16(props))
+			if len(props) < valueSize+2 {
+				return 0, fmt.Errorf("%w: property %#02x exceeds property length", ErrProtocol, id)
+			}
+			valueSize += 2 + int(binary.BigEndian.Uint16(props[valueSize:]))
+		default:
+			return 0, fmt.Errorf("%w: unknown property identifier %#02x", ErrProtocol, id)
+		}
+		if valueSize > len(props) {
+			return 0, fmt.Errorf("%w: property %#02x exceeds property length", ErrProtocol, id)
+		}
+
+		switch id {
+		case propContentType, propResponseTopic, propAssignedClientID, propAuthMethod, propResponseInfo, propServerReference, propReasonString, propCorrelationData, propAuthData:
+			f(id, props[2:valueSize])
+		default:
+			f(id, props[:valueSize])
+		}
+		props = props[valueSize:]
+	}
+	return n + length, nil
+}
@@ -0,0 +1,121 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ProxyDialer establishes connections through a proxy. The interface matches
+// Dialer from golang.org/x/net/proxy, including SOCKS5 from proxy.SOCKS5, and
+// proxy.FromEnvironment for HTTP_PROXY and friends.
+type ProxyDialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// NewProxyDialer provides plain network connections through proxy. Proxies
+// with a DialContext method, like proxy.ContextDialer, get the context with the
+// PauseTimeout deadline. Other proxies get abandoned once the deadline passes.
+func NewProxyDialer(network, address string, proxy ProxyDialer) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		return proxyDial(ctx, proxy, network, address)
+	}
+}
+
+// NewProxyTLSDialer provides secured network connections through proxy. The
+// TLS handshake happens over the proxied connection, with the host from address
+// as the server name, unless config has one already. The config may be nil.
+func NewProxyTLSDialer(network, address string, proxy ProxyDialer, config *tls.Config) Dialer {
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := proxyDial(ctx, proxy, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsHandshake(ctx, tlsConn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func proxyDial(ctx context.Context, proxy ProxyDialer, network, address string) (net.Conn, error) {
+	type contextDialer interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	}
+	if d, ok := proxy.(contextDialer); ok {
+		return d.DialContext(ctx, network, address)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resultQ := make(chan result, 1)
+	go func() {
+		conn, err := proxy.Dial(network, address)
+		resultQ <- result{conn, err}
+	}()
+	select {
+	case r := <-resultQ:
+		return r.conn, r.err
+	case <-ctx.Done():
+		// discard late arrival
+		go func() {
+			if r := <-resultQ; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// TlsHandshake applies the context on the handshake with connection deadlines,
+// as tls.Conn.HandshakeContext requires Go 1.17.
+func tlsHandshake(ctx context.Context, conn *tls.Conn) error {
+	// clear any deadline, including the one from an abort
+	defer conn.SetDeadline(time.Time{})
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	// abort on cancel
+	var aborted bool
+	done := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			aborted = true
+		case <-done:
+			break
+		}
+	}()
+
+	err := conn.Handshake()
+	close(done)
+	<-watchDone
+	if aborted || err != nil && ctx.Err() != nil {
+		return fmt.Errorf("mqtt: TLS handshake: %w", ctx.Err())
+	}
+	return err
+}
@@ -1,12 +1,19 @@
 package mqtt
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	mathrand "math/rand"
 	"net"
+	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ErrMax denies a request on transit capacity, which prevents the Client from
@@ -27,6 +34,9 @@ var ErrAbandoned = errors.New("mqtt: request abandoned after submission")
 // The broker received the request, yet the result/response remains unknown.
 var ErrBreak = errors.New("mqtt: connection lost while awaiting response")
 
+// ErrVolatilePublish is issued with Config.Warn.
+var errVolatilePublish = errors.New("mqtt: publish with delivery guarantee on volatile session; pending messages are lost when the process exits")
+
 // BufSize should fit topic names with a bit of overhead.
 const bufSize = 128
 
@@ -74,7 +84,15 @@ func (c *Client) Ping(quit <-chan struct{}) error {
 
 func (c *Client) onPINGRESP() error {
 	if len(c.peek) != 0 {
-		return fmt.Errorf("%w: PINGRESP with %d byte remaining length", errProtoReset, len(c.peek))
+		return fmt.Errorf("%w: PINGRESP with %d byte remaining length", ErrProtocol, len(c.peek))
+	}
+	// A PINGREQ from the keep-alive precedes any Ping pending.
+	select {
+	case pong := <-c.keepAlivePong:
+		close(pong)
+		return nil
+	default:
+		break
 	}
 	select {
 	case ack := <-c.pingAck:
@@ -107,6 +125,25 @@ var (
 	// protocol violation.”
 	// — MQTT Version 3.1.1, conformance statement MQTT-3.10.3-2
 	errUnsubscribeNone = errors.New("mqtt: UNSUBSCRIBE without topic filters denied")
+
+	// SubscribeLevels needs exactly one level per topic filter.
+	errSubscribeLevels = errors.New("mqtt: SUBSCRIBE with a level count other than its topic filter count denied")
+
+	// “The Server MUST treat a SUBSCRIBE packet as malformed and close
+	// the Network Connection if any of Reserved bits in the payload are
+	// non-zero, or QoS is not 0,1 or 2.”
+	// — MQTT Version 3.1.1, conformance statement MQTT-3.8.3-4
+	errSubscribeLevel = errors.New("mqtt: SUBSCRIBE with a quality-of-service level other than 0, 1 or 2 denied")
+
+	// “It is a Protocol Error to send a Retain Handling value of 3.”
+	// — MQTT Version 5.0, subsection 3.8.3.1
+	errRetainHandling = errors.New("mqtt: SUBSCRIBE with retain handling other than 0, 1 or 2 denied")
+
+	// MQTT 3.1.1 has reserved bits instead of subscription options.
+	errSubscribeOptions = errors.New("mqtt: SUBSCRIBE options other than the quality-of-service level require protocol level 5")
+
+	// MQTT 3.1.1 has no properties on PUBLISH.
+	errPublishOptions = errors.New("mqtt: PUBLISH options other than retain require protocol level 5")
 )
 
 // A total for four types of client requests require a 16-bit packet identifier,
@@ -131,30 +168,27 @@ const (
 // respective address spaces, defined by subscribeIDSpace, unsubscribeIDSpace,
 // atLeastOnceIDSpace and exactlyOnceIDSpace. This extra check has a potential
 // to detect corruptions which would otherwise go unnoticed.
-var errPacketIDSpace = fmt.Errorf("%w: packet ID space mismatch", errProtoReset)
+var errPacketIDSpace = fmt.Errorf("%w: packet ID space mismatch", ErrProtocol)
 
 // UnorderedTxs tracks outbound transactions without sequence contraints.
 type unorderedTxs struct {
 	sync.Mutex
 	n           uint                         // counter is permitted to overflow
 	perPacketID map[uint16]unorderedCallback // transit state
+
+	onReserve, onFree func(packetID uint) // optional hooks from Config
 }
 
 type unorderedCallback struct {
 	done         chan<- error
 	topicFilters []string
+	options      []byte // subscription options per filter
+	granted      []byte // return code per filter, set before done
 }
 
 // StartTx assigns a slot for either a subscribe or an unsubscribe.
-// The filter slice is nil for unsubscribes only.
-func (txs *unorderedTxs) startTx(topicFilters []string) (packetID uint16, done <-chan error, err error) {
-	var space uint
-	if topicFilters == nil {
-		space = unsubscribeIDSpace
-	} else {
-		space = subscribeIDSpace
-	}
-
+// The space is either subscribeIDSpace or unsubscribeIDSpace.
+func (txs *unorderedTxs) startTx(space uint, topicFilters []string, options, granted []byte) (packetID uint16, done <-chan error, err error) {
 	// Only one response error can be applied on done.
 	ch := make(chan error, 1)
 
@@ -177,19 +211,30 @@ func (txs *unorderedTxs) startTx(topicFilters []string) (packetID uint16, done <
 		}
 		txs.perPacketID[packetID] = unorderedCallback{
 			topicFilters: topicFilters,
+			options:      options,
+			granted:      granted,
 			done:         ch,
 		}
+		if txs.onReserve != nil {
+			txs.onReserve(uint(packetID))
+		}
 		return packetID, ch, nil
 	}
 }
 
-// EndTx releases a slot. The filter slice is nil for unsubscribe requests.
-func (txs *unorderedTxs) endTx(packetID uint16) (done chan<- error, topicFilters []string) {
+// EndTx releases a slot.
+// The done channel is nil when no slot was assigned to packetID.
+func (txs *unorderedTxs) endTx(packetID uint16) unorderedCallback {
 	txs.Lock()
 	defer txs.Unlock()
-	callback := txs.perPacketID[packetID]
-	delete(txs.perPacketID, packetID)
-	return callback.done, callback.topicFilters
+	callback, ok := txs.perPacketID[packetID]
+	if ok {
+		delete(txs.perPacketID, packetID)
+		if txs.onFree != nil {
+			txs.onFree(uint(packetID))
+		}
+	}
+	return callback
 }
 
 func (txs *unorderedTxs) breakAll() {
@@ -197,10 +242,83 @@ func (txs *unorderedTxs) breakAll() {
 	defer txs.Unlock()
 	for packetID, callback := range txs.perPacketID {
 		delete(txs.perPacketID, packetID)
+		if txs.onFree != nil {
+			txs.onFree(uint(packetID))
+		}
 		callback.done <- fmt.Errorf("%w; subscription change not confirmed", ErrBreak)
 	}
 }
 
+// Subscriptions tracks the topic filters confirmed by the broker.
+type subscriptions struct {
+	sync.Mutex
+	options map[string]byte // subscription options requested
+}
+
+func (subs *subscriptions) add(topicFilter string, options byte) {
+	subs.Lock()
+	defer subs.Unlock()
+	if subs.options == nil {
+		subs.options = make(map[string]byte)
+	}
+	subs.options[topicFilter] = options
+}
+
+func (subs *subscriptions) remove(topicFilter string) {
+	subs.Lock()
+	defer subs.Unlock()
+	delete(subs.options, topicFilter)
+}
+
+// Match returns each topic filter which matches topic in sorted order.
+func (subs *subscriptions) match(topic string) []string {
+	subs.Lock()
+	defer subs.Unlock()
+	var filters []string
+	for filter := range subs.options {
+		if TopicMatch(filter, topic) {
+			filters = append(filters, filter)
+		}
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// List returns each topic filter in sorted order, with the respective options.
+func (subs *subscriptions) list() (topicFilters []string, options []byte) {
+	subs.Lock()
+	defer subs.Unlock()
+	for filter := range subs.options {
+		topicFilters = append(topicFilters, filter)
+	}
+	sort.Strings(topicFilters)
+	options = make([]byte, len(topicFilters))
+	for i, filter := range topicFilters {
+		options[i] = subs.options[filter]
+	}
+	return topicFilters, options
+}
+
+// Any returns whether any of the topic filters matches topic.
+func (subs *subscriptions) any(topic string) bool {
+	subs.Lock()
+	defer subs.Unlock()
+	for filter := range subs.options {
+		if TopicMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// WouldReceive returns whether topic matches any of the subscriptions, as
+// confirmed by the broker, and not unsubscribed since. Topics which start with
+// a '$' character do not match the wildcards at the first level, conform the
+// MQTT specification. Note that the broker may apply additional restrictions.
+func (c *Client) WouldReceive(topic string) bool {
+	return c.subs.any(topic)
+}
+
 // Subscribe requests subscription for all topics that match any of the filter
 // arguments.
 //
@@ -223,24 +341,171 @@ func (c *Client) SubscribeLimitAtLeastOnce(quit <-chan struct{}, topicFilters ..
 }
 
 func (c *Client) subscribeLevel(quit <-chan struct{}, topicFilters []string, levelMax byte) error {
+	levels := make([]byte, len(topicFilters))
+	for i := range levels {
+		levels[i] = levelMax
+	}
+	_, err := c.SubscribeLevels(quit, topicFilters, levels)
+	return err
+}
+
+// Resubscribe restores subscriptions on a new connection. Failures go to
+// Config.Warn.
+func (c *Client) resubscribe(topicFilters []string, options []byte) {
+	_, err := c.subscribe(nil, topicFilters, options)
+	if err != nil && !errors.Is(err, ErrClosed) {
+		c.warn(fmt.Errorf("mqtt: resubscribe after reconnect: %w", err))
+	}
+}
+
+// SubscribeLevels is like Subscribe, but with a quality-of-service limit per
+// topic filter, with 0 for “at most once”, 1 for “at least once”, and 2 for
+// “exactly once”. The levels granted by the broker are in the same order as
+// the topic filters. Failed topic filters have a return code of 0x80 or above
+// instead, as listed in the SubscribeError.
+func (c *Client) SubscribeLevels(quit <-chan struct{}, topicFilters []string, levelMax []byte) (granted []byte, err error) {
+	if len(topicFilters) == 0 {
+		return nil, errSubscribeNone
+	}
+	if len(levelMax) != len(topicFilters) {
+		return nil, fmt.Errorf("%w: got %d levels for %d topic filters", errSubscribeLevels, len(levelMax), len(topicFilters))
+	}
+	for i, level := range levelMax {
+		if level > exactlyOnceLevel {
+			return nil, fmt.Errorf("%w: got %d for topic filter %q", errSubscribeLevel, level, topicFilters[i])
+		}
+	}
+	return c.subscribe(quit, topicFilters, levelMax)
+}
+
+// SubscribeOptions are the subscription options per topic filter. Any option
+// other than the LevelMax requires ProtocolLevel 5.
+type SubscribeOptions struct {
+	// LevelMax limits the quality-of-service, with 0 for “at most once”,
+	// 1 for “at least once”, and 2 for “exactly once”.
+	LevelMax byte
+
+	// NoLocal excludes messages published by the Client itself.
+	NoLocal bool
+
+	// RetainAsPublished keeps the retain flag as published, instead of
+	// clearing it for messages which are not retained messages.
+	RetainAsPublished bool
+
+	// RetainHandling controls retained messages on subscribe, with 0 to
+	// send them, with 1 to send them only when the subscription is new,
+	// and with 2 to send none.
+	RetainHandling byte
+}
+
+// SubscribeWithOptions is like SubscribeLevels, but with SubscribeOptions per
+// topic filter.
+func (c *Client) SubscribeWithOptions(quit <-chan struct{}, topicFilters []string, options []SubscribeOptions) (granted []byte, err error) {
 	if len(topicFilters) == 0 {
-		return errSubscribeNone
+		return nil, errSubscribeNone
+	}
+	if len(options) != len(topicFilters) {
+		return nil, fmt.Errorf("%w: got %d options for %d topic filters", errSubscribeLevels, len(options), len(topicFilters))
 	}
-	size := 2 + len(topicFilters)*3
+	optionBytes := make([]byte, len(options))
+	for i, o := range options {
+		b, err := c.encodeSubscribeOptions(o)
+		if err != nil {
+			return nil, fmt.Errorf("%w; for topic filter %q", err, topicFilters[i])
+		}
+		optionBytes[i] = b
+	}
+	return c.subscribe(quit, topicFilters, optionBytes)
+}
+
+// EncodeSubscribeOptions returns the options byte for a SUBSCRIBE.
+func (c *Client) encodeSubscribeOptions(o SubscribeOptions) (byte, error) {
+	switch {
+	case o.LevelMax > exactlyOnceLevel:
+		return 0, fmt.Errorf("%w: got %d", errSubscribeLevel, o.LevelMax)
+	case o.RetainHandling > 2:
+		return 0, fmt.Errorf("%w: got %d", errRetainHandling, o.RetainHandling)
+	}
+	b := o.LevelMax | o.RetainHandling<<4
+	if o.NoLocal {
+		b |= 1 << 2
+	}
+	if o.RetainAsPublished {
+		b |= 1 << 3
+	}
+	if b > exactlyOnceLevel && c.ProtocolLevel != 5 {
+		return 0, fmt.Errorf("%w: got %#02x", errSubscribeOptions, b)
+	}
+	return b, nil
+}
+
+func decodeSubscribeOptions(b byte) SubscribeOptions {
+	return SubscribeOptions{
+		LevelMax:          b & 0b11,
+		NoLocal:           b&(1<<2) != 0,
+		RetainAsPublished: b&(1<<3) != 0,
+		RetainHandling:    b >> 4 & 0b11,
+	}
+}
+
+// Subscription is a topic filter with its options.
+type Subscription struct {
+	TopicFilter string
+	SubscribeOptions
+}
+
+// ExportSubscriptions returns each subscription confirmed by the broker, and
+// not unsubscribed since, in order of topic filter.
+func (c *Client) ExportSubscriptions() []Subscription {
+	topicFilters, options := c.subs.list()
+	subs := make([]Subscription, len(topicFilters))
+	for i, filter := range topicFilters {
+		subs[i] = Subscription{filter, decodeSubscribeOptions(options[i])}
+	}
+	return subs
+}
+
+// ImportSubscriptions adds subscriptions, e.g., from ExportSubscriptions, to
+// the set which is resubscribed on each connect, unless Config.NoResubscribe
+// is set. Subscriptions take effect with the next connect. Any illegal entry
+// denies the import as a whole.
+func (c *Client) ImportSubscriptions(subs []Subscription) error {
+	options := make([]byte, len(subs))
+	for i, sub := range subs {
+		if err := topicFilterCheck(sub.TopicFilter); err != nil {
+			return fmt.Errorf("mqtt: subscription import denied on topic filter: %w", err)
+		}
+		b, err := c.encodeSubscribeOptions(sub.SubscribeOptions)
+		if err != nil {
+			return fmt.Errorf("%w; for topic filter %q", err, sub.TopicFilter)
+		}
+		options[i] = b
+	}
+	for i, sub := range subs {
+		c.subs.add(sub.TopicFilter, options[i])
+	}
+	return nil
+}
+
+// Subscribe submits a SUBSCRIBE with an options byte per topic filter.
+func (c *Client) subscribe(quit <-chan struct{}, topicFilters []string, options []byte) (granted []byte, err error) {
+	props := c.requestProperties()
+	size := 2 + len(props) + len(topicFilters)*3
 	for _, s := range topicFilters {
-		if err := topicCheck(s); err != nil {
-			return fmt.Errorf("mqtt: SUBSCRIBE request denied on topic filter: %w", err)
+		if err := topicFilterCheck(s); err != nil {
+			return nil, fmt.Errorf("mqtt: SUBSCRIBE request denied on topic filter: %w", err)
 		}
 		size += len(s)
 	}
 	if size > packetMax {
-		return fmt.Errorf("mqtt: SUBSCRIBE request denied: %w", errPacketMax)
+		return nil, fmt.Errorf("mqtt: SUBSCRIBE request denied: %w", errPacketMax)
 	}
 
 	// slot assignment
-	packetID, done, err := c.unorderedTxs.startTx(topicFilters)
+	granted = make([]byte, len(topicFilters))
+	packetID, done, err := c.unorderedTxs.startTx(subscribeIDSpace, topicFilters, options, granted)
 	if err != nil {
-		return fmt.Errorf("%w; SUBSCRIBE unavailable", err)
+		return nil, fmt.Errorf("%w; SUBSCRIBE unavailable", err)
 	}
 
 	// request packet composition
@@ -253,30 +518,37 @@ func (c *Client) subscribeLevel(quit <-chan struct{}, topicFilters []string, lev
 	}
 	packet = append(packet, byte(l))
 	packet = append(packet, byte(packetID>>8), byte(packetID))
-	for _, s := range topicFilters {
+	packet = append(packet, props...)
+	for i, s := range topicFilters {
 		packet = append(packet, byte(len(s)>>8), byte(len(s)))
 		packet = append(packet, s...)
-		packet = append(packet, levelMax)
+		packet = append(packet, options[i])
 	}
 
 	// network submission
 	if err = c.write(quit, packet); err != nil {
 		c.unorderedTxs.endTx(packetID) // releases slot
-		return fmt.Errorf("%w; SUBSCRIBE request interrupted", err)
+		return nil, fmt.Errorf("%w; SUBSCRIBE request interrupted", err)
 	}
 
 	select {
-	case err := <-done:
-		return err
+	case err, ok := <-done:
+		if ok && err != nil {
+			var failed SubscribeError
+			if !errors.As(err, &failed) {
+				return nil, err
+			}
+		}
+		return granted, err
 	case <-quit:
 		c.unorderedTxs.endTx(packetID) // releases slot
-		return fmt.Errorf("%w; SUBSCRIBE not confirmed", ErrAbandoned)
+		return nil, fmt.Errorf("%w; SUBSCRIBE not confirmed", ErrAbandoned)
 	}
 }
 
 func (c *Client) onSUBACK() error {
 	if len(c.peek) < 3 {
-		return fmt.Errorf("%w: SUBACK with %d byte remaining length", errProtoReset, len(c.peek))
+		return fmt.Errorf("%w: SUBACK with %d byte remaining length", ErrProtocol, len(c.peek))
 	}
 	packetID := binary.BigEndian.Uint16(c.peek)
 	switch {
@@ -287,36 +559,57 @@ func (c *Client) onSUBACK() error {
 	}
 
 	returnCodes := c.peek[2:]
+	if c.ProtocolLevel == 5 {
+		n, err := eachProperty(returnCodes, func(id byte, value []byte) {})
+		if err != nil {
+			return err
+		}
+		returnCodes = returnCodes[n:]
+	}
 	var failN int
 	for _, code := range returnCodes {
-		switch code {
-		case atMostOnceLevel, atLeastOnceLevel, exactlyOnceLevel:
+		switch {
+		case code <= exactlyOnceLevel:
 			break
-		case 0x80:
+		case code == 0x80, code > 0x80 && c.ProtocolLevel == 5:
 			failN++
 		default:
-			return fmt.Errorf("%w: SUBACK with illegal return code %#02x", errProtoReset, code)
+			return fmt.Errorf("%w: SUBACK with illegal return code %#02x", ErrProtocol, code)
 		}
 	}
 
 	// commit
-	done, topicFilters := c.unorderedTxs.endTx(packetID)
+	callback := c.unorderedTxs.endTx(packetID)
+	done, topicFilters := callback.done, callback.topicFilters
 	if done == nil { // hopefully due ErrAbandoned
 		return nil
 	}
-
 	// “The SUBACK Packet sent by the Server to the Client MUST contain a
 	// return code for each Topic Filter/QoS pair. …”
 	// — MQTT Version 3.1.1, conformance statement MQTT-3.8.4-5
 	if len(topicFilters) != len(returnCodes) {
 		done <- fmt.Errorf("mqtt: %d return codes for SUBSCRIBE with %d topic filters", len(returnCodes), len(topicFilters))
-		return errProtoReset
+		return ErrProtocol
 	}
 
+	for i, code := range returnCodes {
+		if code < callback.options[i]&0b11 {
+			atomic.AddUint64(&c.stats.SubscribeDowngrades, 1)
+		}
+	}
+	copy(callback.granted, returnCodes)
+	if c.DropRetained > 0 {
+		c.retainedDrop = time.Now().Add(c.DropRetained)
+	}
+	for i, code := range returnCodes {
+		if code < 0x80 {
+			c.subs.add(topicFilters[i], callback.options[i])
+		}
+	}
 	if failN != 0 {
 		var err SubscribeError
 		for i, code := range returnCodes {
-			if code == 0x80 {
+			if code >= 0x80 {
 				err = append(err, topicFilters[i])
 			}
 		}
@@ -335,10 +628,11 @@ func (c *Client) Unsubscribe(quit <-chan struct{}, topicFilters ...string) error
 	if len(topicFilters) == 0 {
 		return errUnsubscribeNone
 	}
-	size := 2 + len(topicFilters)*2
+	props := c.requestProperties()
+	size := 2 + len(props) + len(topicFilters)*2
 	for _, s := range topicFilters {
 		size += len(s)
-		if err := topicCheck(s); err != nil {
+		if err := topicFilterCheck(s); err != nil {
 			return fmt.Errorf("mqtt: UNSUBSCRIBE request denied on topic filter: %w", err)
 		}
 	}
@@ -347,7 +641,7 @@ func (c *Client) Unsubscribe(quit <-chan struct{}, topicFilters ...string) error
 	}
 
 	// slot assignment
-	packetID, done, err := c.unorderedTxs.startTx(nil)
+	packetID, done, err := c.unorderedTxs.startTx(unsubscribeIDSpace, topicFilters, nil, nil)
 	if err != nil {
 		return fmt.Errorf("%w; UNSUBSCRIBE unavailable", err)
 	}
@@ -363,6 +657,7 @@ func (c *Client) Unsubscribe(quit <-chan struct{}, topicFilters ...string) error
 	}
 	packet = append(packet, byte(l))
 	packet = append(packet, byte(packetID>>8), byte(packetID))
+	packet = append(packet, props...)
 	// payload
 	for _, s := range topicFilters {
 		packet = append(packet, byte(len(s)>>8), byte(len(s)))
@@ -385,8 +680,8 @@ func (c *Client) Unsubscribe(quit <-chan struct{}, topicFilters ...string) error
 }
 
 func (c *Client) onUNSUBACK() error {
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: UNSUBACK with %d byte remaining length", errProtoReset, len(c.peek))
+	if len(c.peek) != 2 && (len(c.peek) < 2 || c.ProtocolLevel != 5) {
+		return fmt.Errorf("%w: UNSUBACK with %d byte remaining length", ErrProtocol, len(c.peek))
 	}
 	packetID := binary.BigEndian.Uint16(c.peek)
 	switch {
@@ -395,10 +690,33 @@ func (c *Client) onUNSUBACK() error {
 	case packetID&^unorderedIDMask != unsubscribeIDSpace:
 		return errPacketIDSpace
 	}
-	done, _ := c.unorderedTxs.endTx(packetID)
-	if done != nil {
-		close(done)
+
+	// MQTT version 5.0 has a reason code per topic filter.
+	var reasonCodes []byte
+	if len(c.peek) > 2 {
+		n, err := eachProperty(c.peek[2:], func(id byte, value []byte) {})
+		if err != nil {
+			return err
+		}
+		reasonCodes = c.peek[2+n:]
+	}
+
+	callback := c.unorderedTxs.endTx(packetID)
+	if callback.done == nil { // hopefully due ErrAbandoned
+		return nil
+	}
+	var err SubscribeError
+	for i, topicFilter := range callback.topicFilters {
+		if i < len(reasonCodes) && reasonCodes[i] >= 0x80 {
+			err = append(err, topicFilter)
+		} else {
+			c.subs.remove(topicFilter)
+		}
+	}
+	if len(err) != 0 {
+		callback.done <- err
 	}
+	close(callback.done)
 	return nil
 }
 
@@ -410,6 +728,51 @@ type orderedTxs struct {
 	Completed uint // confirm count 2/2 for PublishExactlyOnce
 }
 
+// QueueTimes tracks the submission time of each pending publish request.
+type queueTimes struct {
+	sync.Mutex
+	atLeastOnce, exactlyOnce []time.Time // in order of submission
+}
+
+func (q *queueTimes) push(times *[]time.Time, t time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	*times = append(*times, t)
+}
+
+func (q *queueTimes) pop(times *[]time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	if len(*times) != 0 {
+		*times = (*times)[1:]
+	}
+}
+
+func (q *queueTimes) clear(times *[]time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	*times = nil
+}
+
+// Backlog returns the number of entries, and the age of the oldest entry.
+func (q *queueTimes) backlog() (n int, age time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	n = len(q.atLeastOnce) + len(q.exactlyOnce)
+	var oldest time.Time
+	switch {
+	case len(q.atLeastOnce) == 0 && len(q.exactlyOnce) == 0:
+		return n, 0
+	case len(q.atLeastOnce) == 0:
+		oldest = q.exactlyOnce[0]
+	case len(q.exactlyOnce) == 0, q.atLeastOnce[0].Before(q.exactlyOnce[0]):
+		oldest = q.atLeastOnce[0]
+	default:
+		oldest = q.exactlyOnce[0]
+	}
+	return n, time.Since(oldest)
+}
+
 type holdup struct {
 	SinceSeqNo uint // oldest entry
 	UntilSeqNo uint // latest entry
@@ -417,18 +780,122 @@ type holdup struct {
 
 // Publish delivers the message with an “at most once” guarantee.
 // Subscribers may or may not receive the message when subject to error.
-// This delivery method is the most efficient option.
+// This delivery method is the most efficient option. With ProtocolLevel 5, the
+// topic goes as an alias when the broker permits. Each publication after the
+// first one on a topic has a two byte number instead, per connection, up to the
+// Topic Alias Maximum from the broker.
 //
 // Quit is optional, as nil just blocks. Appliance of quit will strictly result
 // in ErrCanceled.
 func (c *Client) Publish(quit <-chan struct{}, message []byte, topic string) error {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := appendPublishPacket(buf, message, topic, 0, typePUBLISH<<4)
+	packet, err := appendPublishPacket(buf, message, topic, 0, typePUBLISH<<4, c.publishProperties())
+	if err != nil {
+		return err
+	}
+	err = c.writeBuffers(quit, packet)
+	if err == nil {
+		c.countPublish(len(message))
+	}
+	return err
+}
+
+// PublishJSON is like Publish, but with the JSON encoding of v as the message.
+// Encoding errors are returned as is, without any request submission. Version
+// 5.0 labels the message with content type "application/json". Note that MQTT
+// version 3.1.1 has no means to label the content type.
+func (c *Client) PublishJSON(quit <-chan struct{}, v interface{}, topic string) error {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.PublishWithOptions(quit, message, topic, c.jsonOptions())
+}
+
+// PublishAtLeastOnceJSON is like PublishJSON, but with the delivery guarantee
+// of PublishAtLeastOnce.
+func (c *Client) PublishAtLeastOnceJSON(v interface{}, topic string) (exchange <-chan error, err error) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.PublishAtLeastOnceWithOptions(message, topic, c.jsonOptions())
+}
+
+// PublishExactlyOnceJSON is like PublishJSON, but with the delivery guarantee
+// of PublishExactlyOnce.
+func (c *Client) PublishExactlyOnceJSON(v interface{}, topic string) (exchange <-chan error, err error) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.PublishExactlyOnceWithOptions(message, topic, c.jsonOptions())
+}
+
+// JSONOptions returns the PublishOptions for JSON messages.
+func (c *Config) jsonOptions() PublishOptions {
+	if c.ProtocolLevel != 5 {
+		return PublishOptions{}
+	}
+	return PublishOptions{ContentType: "application/json"}
+}
+
+// PublishFile is like Publish, but with the content of the named file as the
+// message. The file is read in full, up to the packet size limit. File errors
+// are returned as is, without any request submission.
+func (c *Client) PublishFile(quit <-chan struct{}, name, topic string) error {
+	message, err := readFileMessage(name)
 	if err != nil {
 		return err
 	}
-	return c.writeBuffers(quit, packet)
+	return c.Publish(quit, message, topic)
+}
+
+// PublishAtLeastOnceFile is like PublishAtLeastOnce, but with the content of
+// the named file as the message. See PublishFile for the file handling.
+func (c *Client) PublishAtLeastOnceFile(name, topic string) (exchange <-chan error, err error) {
+	message, err := readFileMessage(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.PublishAtLeastOnce(message, topic)
+}
+
+// PublishExactlyOnceFile is like PublishExactlyOnce, but with the content of
+// the named file as the message. See PublishFile for the file handling.
+func (c *Client) PublishExactlyOnceFile(name, topic string) (exchange <-chan error, err error) {
+	message, err := readFileMessage(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.PublishExactlyOnce(message, topic)
+}
+
+// ReadFileMessage reads the named file without exceeding packetMax, which
+// also applies to files without a size, like pipes and devices.
+func readFileMessage(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > packetMax {
+		return nil, fmt.Errorf("mqtt: PUBLISH request denied on file %q: %w", name, errPacketMax)
+	}
+	message, err := io.ReadAll(io.LimitReader(f, packetMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > packetMax {
+		return nil, fmt.Errorf("mqtt: PUBLISH request denied on file %q: %w", name, errPacketMax)
+	}
+	return message, nil
 }
 
 // PublishRetained is like Publish, but the broker should store the message, so
@@ -439,11 +906,21 @@ func (c *Client) Publish(quit <-chan struct{}, message []byte, topic string) err
 func (c *Client) PublishRetained(quit <-chan struct{}, message []byte, topic string) error {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := appendPublishPacket(buf, message, topic, 0, typePUBLISH<<4|retainFlag)
+	packet, err := appendPublishPacket(buf, message, topic, 0, typePUBLISH<<4|retainFlag, c.publishProperties())
 	if err != nil {
 		return err
 	}
-	return c.writeBuffers(quit, packet)
+	err = c.writeBuffers(quit, packet)
+	if err == nil {
+		c.countPublish(len(message))
+	}
+	return err
+}
+
+// ClearRetained removes the message retained for the topic name, if any, from
+// the broker. The request is a PublishRetained with an empty message.
+func (c *Client) ClearRetained(quit <-chan struct{}, topic string) error {
+	return c.PublishRetained(quit, nil, topic)
 }
 
 // PublishAtLeastOnce delivers the message with an “at least once” guarantee.
@@ -451,16 +928,35 @@ func (c *Client) PublishRetained(quit <-chan struct{}, message []byte, topic str
 // This delivery method requires a response transmission plus persistence on
 // both client-side and broker-side.
 //
+// A nil error return implies that the message was saved in the Persistence
+// before submission, i.e., it survives a restart with PersistentSession on
+// FileSystem. The same applies to PublishExactlyOnce.
+//
 // The exchange channel is closed uppon receival confirmation by the broker.
-// ErrClosed leaves the channel blocked (with no further input).
+// Connection loss before then causes an ErrDown, after which the exchange
+// resumes. ErrClosed leaves the channel blocked (with no further input).
 func (c *Client) PublishAtLeastOnce(message []byte, topic string) (exchange <-chan error, err error) {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := appendPublishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1)
+	packet, err := appendPublishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1, c.publishProperties())
 	if err != nil {
 		return nil, err
 	}
-	return c.submitPersisted(packet, c.atLeastOnceSem, c.atLeastOnceQ, c.atLeastOnceBlock)
+	_, exchange, err = c.submitPersisted(packet, c.atLeastOnceSem, c.atLeastOnceQ, c.atLeastOnceBlock, &c.queueTimes.atLeastOnce)
+	return exchange, err
+}
+
+// PublishAtLeastOnceTracked is like PublishAtLeastOnce, but it also returns the
+// packet identifier of the PUBLISH, for correlation with the transmission.
+// Packet identifiers are reused once the broker confirmed the exchange.
+func (c *Client) PublishAtLeastOnceTracked(message []byte, topic string) (packetID uint, exchange <-chan error, err error) {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := appendPublishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1, c.publishProperties())
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.submitPersisted(packet, c.atLeastOnceSem, c.atLeastOnceQ, c.atLeastOnceBlock, &c.queueTimes.atLeastOnce)
 }
 
 // PublishAtLeastOnceRetained is like PublishAtLeastOnce, but the broker must
@@ -471,11 +967,12 @@ func (c *Client) PublishAtLeastOnce(message []byte, topic string) (exchange <-ch
 func (c *Client) PublishAtLeastOnceRetained(message []byte, topic string) (exchange <-chan error, err error) {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := appendPublishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1|retainFlag)
+	packet, err := appendPublishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1|retainFlag, c.publishProperties())
 	if err != nil {
 		return nil, err
 	}
-	return c.submitPersisted(packet, c.atLeastOnceSem, c.atLeastOnceQ, c.atLeastOnceBlock)
+	_, exchange, err = c.submitPersisted(packet, c.atLeastOnceSem, c.atLeastOnceQ, c.atLeastOnceBlock, &c.queueTimes.atLeastOnce)
+	return exchange, err
 }
 
 // PublishExactlyOnce delivers the message with an “exactly once” guarantee.
@@ -484,11 +981,25 @@ func (c *Client) PublishAtLeastOnceRetained(message []byte, topic string) (excha
 func (c *Client) PublishExactlyOnce(message []byte, topic string) (exchange <-chan error, err error) {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := appendPublishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1)
+	packet, err := appendPublishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1, c.publishProperties())
 	if err != nil {
 		return nil, err
 	}
-	return c.submitPersisted(packet, c.exactlyOnceSem, c.exactlyOnceQ, c.exactlyOnceBlock)
+	_, exchange, err = c.submitPersisted(packet, c.exactlyOnceSem, c.exactlyOnceQ, c.exactlyOnceBlock, &c.queueTimes.exactlyOnce)
+	return exchange, err
+}
+
+// PublishExactlyOnceTracked is like PublishExactlyOnce, but it also returns the
+// packet identifier of the PUBLISH, for correlation with the transmission.
+// Packet identifiers are reused once the broker confirmed the exchange.
+func (c *Client) PublishExactlyOnceTracked(message []byte, topic string) (packetID uint, exchange <-chan error, err error) {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := appendPublishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1, c.publishProperties())
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.submitPersisted(packet, c.exactlyOnceSem, c.exactlyOnceQ, c.exactlyOnceBlock, &c.queueTimes.exactlyOnce)
 }
 
 // PublishExactlyOnceRetained is like PublishExactlyOnce, but the broker must
@@ -499,31 +1010,280 @@ func (c *Client) PublishExactlyOnce(message []byte, topic string) (exchange <-ch
 func (c *Client) PublishExactlyOnceRetained(message []byte, topic string) (exchange <-chan error, err error) {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := appendPublishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1|retainFlag)
+	packet, err := appendPublishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1|retainFlag, c.publishProperties())
+	if err != nil {
+		return nil, err
+	}
+	_, exchange, err = c.submitPersisted(packet, c.exactlyOnceSem, c.exactlyOnceQ, c.exactlyOnceBlock, &c.queueTimes.exactlyOnce)
+	return exchange, err
+}
+
+// PublishAtLeastOnceBlocking is like PublishAtLeastOnce, but it waits for the
+// window on ErrMax, instead of returning the error. See WindowAvailable.
+//
+// Quit is optional, as nil just blocks. Appliance of quit will strictly result
+// in ErrCanceled.
+func (c *Client) PublishAtLeastOnceBlocking(quit <-chan struct{}, message []byte, topic string) (exchange <-chan error, err error) {
+	return c.publishBlocking(quit, func() (<-chan error, error) {
+		return c.PublishAtLeastOnce(message, topic)
+	})
+}
+
+// PublishExactlyOnceBlocking is like PublishExactlyOnce, but it waits for the
+// window on ErrMax, instead of returning the error. See WindowAvailable.
+//
+// Quit is optional, as nil just blocks. Appliance of quit will strictly result
+// in ErrCanceled.
+func (c *Client) PublishExactlyOnceBlocking(quit <-chan struct{}, message []byte, topic string) (exchange <-chan error, err error) {
+	return c.publishBlocking(quit, func() (<-chan error, error) {
+		return c.PublishExactlyOnce(message, topic)
+	})
+}
+
+// PublishBlocking retries submit until the error is not an ErrMax.
+func (c *Client) publishBlocking(quit <-chan struct{}, submit func() (<-chan error, error)) (exchange <-chan error, err error) {
+	for {
+		exchange, err = submit()
+		if !errors.Is(err, ErrMax) {
+			return exchange, err
+		}
+		// The signal is pending since ErrMax. Another ErrMax may
+		// follow, as both levels share the signal.
+		select {
+		case <-c.WindowAvailable():
+			break
+		case <-quit:
+			return nil, fmt.Errorf("%w; PUBLISH window unavailable", ErrCanceled)
+		}
+	}
+}
+
+// PublishAtLeastOnceWait is like PublishAtLeastOnceBlocking, but it also awaits
+// the confirmation by the broker. Errors which leave the exchange pending, like
+// ErrDown, do not end the wait. ErrClosed does. See PublishAtLeastOnce.
+//
+// Quit is optional, as nil just blocks. Appliance of quit will strictly result
+// in ErrCanceled. The exchange continues when submitted already.
+func (c *Client) PublishAtLeastOnceWait(quit <-chan struct{}, message []byte, topic string) error {
+	exchange, err := c.PublishAtLeastOnceBlocking(quit, message, topic)
+	if err != nil {
+		return err
+	}
+	return awaitExchange(quit, exchange)
+}
+
+// PublishExactlyOnceWait is like PublishExactlyOnceBlocking, but it also awaits
+// the confirmation by the broker. Errors which leave the exchange pending, like
+// ErrDown, do not end the wait. ErrClosed does. See PublishExactlyOnce.
+//
+// Quit is optional, as nil just blocks. Appliance of quit will strictly result
+// in ErrCanceled. The exchange continues when submitted already.
+func (c *Client) PublishExactlyOnceWait(quit <-chan struct{}, message []byte, topic string) error {
+	exchange, err := c.PublishExactlyOnceBlocking(quit, message, topic)
+	if err != nil {
+		return err
+	}
+	return awaitExchange(quit, exchange)
+}
+
+// AwaitExchange blocks until the exchange ends. Errors which leave the exchange
+// pending, such as ErrDown and write errors, do not end the wait.
+func awaitExchange(quit <-chan struct{}, exchange <-chan error) error {
+	var failure *brokerFailure
+	for {
+		select {
+		case err, ok := <-exchange:
+			if !ok {
+				if failure != nil {
+					return failure // rejected
+				}
+				return nil // confirmed
+			}
+			if errors.Is(err, ErrClosed) || errors.Is(err, ErrMax) {
+				return err
+			}
+			failure = nil
+			errors.As(err, &failure) // close follows
+		case <-quit:
+			return fmt.Errorf("%w; PUBLISH not confirmed", ErrCanceled)
+		}
+	}
+}
+
+// PublishOptions are the per-message options for publication. Any option
+// other than Retain requires ProtocolLevel 5.
+type PublishOptions struct {
+	// Retain applies the semantics of PublishRetained.
+	Retain bool
+
+	// MessageExpiry is the lifetime in seconds, with zero for none. The
+	// broker discards the message when it can not be delivered in time.
+	MessageExpiry uint32
+
+	// ContentType is the MIME type of the message, if any.
+	ContentType string
+}
+
+// PublishWithOptions is like Publish, but with PublishOptions.
+func (c *Client) PublishWithOptions(quit <-chan struct{}, message []byte, topic string, o PublishOptions) error {
+	props, err := c.publishOptionProperties(o)
+	if err != nil {
+		return err
+	}
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := appendPublishPacket(buf, message, topic, 0, typePUBLISH<<4|o.retainFlag(), props)
+	if err != nil {
+		return err
+	}
+	err = c.writeBuffers(quit, packet)
+	if err == nil {
+		c.countPublish(len(message))
+	}
+	return err
+}
+
+// PublishAtLeastOnceWithOptions is like PublishAtLeastOnce, but with
+// PublishOptions.
+func (c *Client) PublishAtLeastOnceWithOptions(message []byte, topic string, o PublishOptions) (exchange <-chan error, err error) {
+	props, err := c.publishOptionProperties(o)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := appendPublishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1|o.retainFlag(), props)
 	if err != nil {
 		return nil, err
 	}
-	return c.submitPersisted(packet, c.exactlyOnceSem, c.exactlyOnceQ, c.exactlyOnceBlock)
+	_, exchange, err = c.submitPersisted(packet, c.atLeastOnceSem, c.atLeastOnceQ, c.atLeastOnceBlock, &c.queueTimes.atLeastOnce)
+	return exchange, err
+}
+
+// PublishExactlyOnceWithOptions is like PublishExactlyOnce, but with
+// PublishOptions.
+func (c *Client) PublishExactlyOnceWithOptions(message []byte, topic string, o PublishOptions) (exchange <-chan error, err error) {
+	props, err := c.publishOptionProperties(o)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := appendPublishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1|o.retainFlag(), props)
+	if err != nil {
+		return nil, err
+	}
+	_, exchange, err = c.submitPersisted(packet, c.exactlyOnceSem, c.exactlyOnceQ, c.exactlyOnceBlock, &c.queueTimes.exactlyOnce)
+	return exchange, err
+}
+
+func (o *PublishOptions) retainFlag() byte {
+	if o.Retain {
+		return retainFlag
+	}
+	return 0
+}
+
+// PublishOptionProperties returns the properties for a PUBLISH with options.
+func (c *Config) publishOptionProperties(o PublishOptions) ([]byte, error) {
+	if o.MessageExpiry == 0 && o.ContentType == "" {
+		return c.publishProperties(), nil
+	}
+	if c.ProtocolLevel != 5 {
+		return nil, errPublishOptions
+	}
+	if err := stringCheck(o.ContentType); err != nil {
+		return nil, fmt.Errorf("mqtt: PUBLISH request denied due content type: %w", err)
+	}
+
+	var size int
+	if o.MessageExpiry != 0 {
+		size += 5
+	}
+	if o.ContentType != "" {
+		size += 3 + len(o.ContentType)
+	}
+	props := appendVarint(make([]byte, 0, 4+size), size)
+	if o.MessageExpiry != 0 {
+		props = append(props, propMessageExpiry,
+			byte(o.MessageExpiry>>24), byte(o.MessageExpiry>>16), byte(o.MessageExpiry>>8), byte(o.MessageExpiry))
+	}
+	if o.ContentType != "" {
+		props = append(props, propContentType, byte(len(o.ContentType)>>8), byte(len(o.ContentType)))
+		props = append(props, o.ContentType...)
+	}
+	return props, nil
+}
+
+// ReceiveReserve claims a slot within the Receive Maximum from the broker, if
+// any. Each claim is pending until either its entry is in the respective queue,
+// or until an abort. Both cases must decrement receivePending [MQTT 5.0].
+func (c *Client) receiveReserve() bool {
+	n := atomic.AddInt32(&c.receivePending, 1)
+	max := atomic.LoadUint32(&c.receiveMax)
+	if max != 0 && len(c.atLeastOnceQ)+len(c.exactlyOnceQ)+int(n) > int(max) {
+		atomic.AddInt32(&c.receivePending, -1)
+		return false
+	}
+	return true
 }
 
-func (c *Client) submitPersisted(packet net.Buffers, sem chan uint, q chan chan<- error, block chan holdup) (exchange <-chan error, err error) {
-	done := make(chan error, 2) // receives at most 1 write error + ErrClosed
+// ReceiveRoom returns whether the Receive Maximum from the broker, if any,
+// permits another PUBLISH with an “at least once” or an “exactly once”
+// guarantee.
+func (c *Client) receiveRoom() bool {
+	max := atomic.LoadUint32(&c.receiveMax)
+	return max == 0 || len(c.atLeastOnceQ)+len(c.exactlyOnceQ)+int(atomic.LoadInt32(&c.receivePending)) < int(max)
+}
+
+func (c *Client) submitPersisted(packet net.Buffers, sem chan uint, q chan chan<- error, block chan holdup, times *[]time.Time) (packetID uint, exchange <-chan error, err error) {
+	if _, ok := c.persistence.(*volatile); ok {
+		c.volatileWarn.Do(func() { c.warn(errVolatilePublish) })
+	}
+
+	c.shutdownMutex.Lock()
+	if c.shuttingDown {
+		c.shutdownMutex.Unlock()
+		return 0, nil, fmt.Errorf("%w; PUBLISH denied on shutdown", ErrClosed)
+	}
+	c.submitting++
+	c.shutdownMutex.Unlock()
+	defer func() {
+		c.shutdownMutex.Lock()
+		c.submitting--
+		c.shutdownMutex.Unlock()
+		c.drainNotify()
+	}()
+
+	done := newExchange()
 	select {
 	case counter, ok := <-sem:
 		if !ok {
-			return nil, fmt.Errorf("%w; PUBLISH unavailable", ErrClosed)
+			return 0, nil, fmt.Errorf("%w; PUBLISH unavailable", ErrClosed)
 		}
 		if cap(q) == len(q) {
 			sem <- counter // unlock
-			return nil, fmt.Errorf("%w; PUBLISH unavailable", ErrMax)
+			c.windowFull(q)
+			return 0, nil, fmt.Errorf("%w; PUBLISH unavailable", ErrMax)
 		}
-		packetID := applyPublishSeqNo(packet, counter)
+		if !c.receiveReserve() {
+			sem <- counter // unlock
+			c.windowFull(q)
+			return 0, nil, fmt.Errorf("%w; PUBLISH unavailable due broker Receive Maximum", ErrMax)
+		}
+		packetID = applyPublishSeqNo(packet, counter)
 		err = c.persistence.Save(packetID, packet)
 		if err != nil {
+			atomic.AddInt32(&c.receivePending, -1)
 			sem <- counter // unlock
-			return nil, fmt.Errorf("%w; PUBLISH dropped", err)
+			return 0, nil, fmt.Errorf("%w; PUBLISH dropped", err)
+		}
+		if c.OnReserve != nil {
+			c.OnReserve(packetID)
 		}
 		q <- done // won't block due ErrMax check
+		atomic.AddInt32(&c.receivePending, -1)
+		c.queueTimes.push(times, time.Now())
 		switch err := c.writeBuffers(c.Offline(), packet); {
 		case err == nil:
 			sem <- counter + 1
@@ -538,27 +1298,48 @@ func (c *Client) submitPersisted(packet net.Buffers, sem chan uint, q chan chan<
 	case holdup := <-block:
 		if cap(q) == len(q) {
 			block <- holdup // unlock
-			return nil, fmt.Errorf("%w; PUBLISH unavailable", ErrMax)
+			c.windowFull(q)
+			return 0, nil, fmt.Errorf("%w; PUBLISH unavailable", ErrMax)
 		}
-		packetID := applyPublishSeqNo(packet, holdup.UntilSeqNo+1)
+		if !c.receiveReserve() {
+			block <- holdup // unlock
+			c.windowFull(q)
+			return 0, nil, fmt.Errorf("%w; PUBLISH unavailable due broker Receive Maximum", ErrMax)
+		}
+		packetID = applyPublishSeqNo(packet, holdup.UntilSeqNo+1)
 		err = c.persistence.Save(packetID, packet)
 		if err != nil {
+			atomic.AddInt32(&c.receivePending, -1)
 			block <- holdup // unlock
-			return nil, fmt.Errorf("%w; PUBLISH dropped", err)
+			return 0, nil, fmt.Errorf("%w; PUBLISH dropped", err)
+		}
+		if c.OnReserve != nil {
+			c.OnReserve(packetID)
 		}
 		q <- done // won't block due ErrMax check
+		atomic.AddInt32(&c.receivePending, -1)
+		c.queueTimes.push(times, time.Now())
 		holdup.UntilSeqNo++
 		block <- holdup
 	}
 
-	return done, nil
+	c.countPublish(len(packet[len(packet)-1]))
+	return packetID, done, nil
 }
 
-func appendPublishPacket(buf *[bufSize]byte, message []byte, topic string, packetID uint, head byte) (net.Buffers, error) {
-	if err := topicCheck(topic); err != nil {
+// NewExchange returns a channel for the errors of a PUBLISH exchange, which
+// receives at most 1 write error + ErrDown + ErrClosed.
+func newExchange() chan error {
+	return make(chan error, 3)
+}
+
+// AppendPublishPacket composes a PUBLISH, with the properties as a separate
+// buffer, if any.
+func appendPublishPacket(buf *[bufSize]byte, message []byte, topic string, packetID uint, head byte, props []byte) (net.Buffers, error) {
+	if err := topicNameCheck(topic); err != nil {
 		return nil, fmt.Errorf("mqtt: PUBLISH request denied due topic: %w", err)
 	}
-	size := 2 + len(topic) + len(message)
+	size := 2 + len(topic) + len(props) + len(message)
 	if packetID != 0 {
 		size += 2
 	}
@@ -577,9 +1358,30 @@ func appendPublishPacket(buf *[bufSize]byte, message []byte, topic string, packe
 	if packetID != 0 {
 		packet = append(packet, byte(packetID>>8), byte(packetID))
 	}
+	if props != nil {
+		return net.Buffers{packet, props, message}, nil
+	}
 	return net.Buffers{packet, message}, nil
 }
 
+// PublishProperties returns the properties for outbound PUBLISH packets, with
+// nil for none [MQTT version 3.1.1].
+func (c *Config) publishProperties() []byte {
+	if c.ProtocolLevel == 5 {
+		return propertiesNone
+	}
+	return nil
+}
+
+// RequestProperties returns the properties for outbound SUBSCRIBE and
+// UNSUBSCRIBE packets, with nil for none [MQTT version 3.1.1].
+func (c *Config) requestProperties() []byte {
+	if c.ProtocolLevel == 5 {
+		return propertiesNone
+	}
+	return nil
+}
+
 // ApplyPublishSeqNo applies a sequence number to a appendPublishPublishPacket
 // composition.
 func applyPublishSeqNo(packet net.Buffers, seqNo uint) (packetID uint) {
@@ -594,8 +1396,9 @@ func applyPublishSeqNo(packet net.Buffers, seqNo uint) (packetID uint) {
 // OnPUBACK applies the confirm of a PublishAtLeastOnce.
 func (c *Client) onPUBACK() error {
 	// parse packet
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: PUBACK with %d byte remaining length", errProtoReset, len(c.peek))
+	failure, err := c.ackFailure("PUBACK")
+	if err != nil {
+		return err
 	}
 	packetID := uint(binary.BigEndian.Uint16(c.peek))
 
@@ -607,26 +1410,88 @@ func (c *Client) onPUBACK() error {
 	case packetID&^publishIDMask != atLeastOnceIDSpace:
 		return errPacketIDSpace
 	case expect != packetID:
-		return fmt.Errorf("%w: PUBACK %#04x while %#04x next in line", errProtoReset, packetID, expect)
+		return fmt.Errorf("%w: PUBACK %#04x while %#04x next in line", ErrProtocol, packetID, expect)
 	case len(c.atLeastOnceQ) == 0:
-		return fmt.Errorf("%w: PUBACK precedes PUBLISH", errProtoReset)
+		return fmt.Errorf("%w: PUBACK precedes PUBLISH", ErrProtocol)
 	}
 
 	// ceil transaction
-	err := c.persistence.Delete(packetID)
+	err = c.persistence.Delete(packetID)
 	if err != nil {
 		return err // causes resubmission of PUBLISH
 	}
 	c.orderedTxs.Acked++
-	close(<-c.atLeastOnceQ)
-	return nil
+	if c.OnFree != nil {
+		c.OnFree(packetID)
+	}
+	endExchange(<-c.atLeastOnceQ, failure)
+	c.windowFree()
+	c.drainNotify()
+	c.queueTimes.pop(&c.queueTimes.atLeastOnce)
+	return c.resendHeld()
+}
+
+// EndExchange closes the channel of a publish exchange. The failure is passed
+// first, if any.
+func endExchange(done chan<- error, failure error) {
+	if failure != nil {
+		select {
+		case done <- failure:
+		default: // full of delivery errors
+		}
+	}
+	close(done)
+}
+
+// AckFailure validates an acknowledgement of PUBLISH or PUBREL in c.peek.
+// MQTT version 5.0 may have a reason code, which signals failure from 0x80.
+func (c *Client) ackFailure(name string) (failure, err error) {
+	switch {
+	case len(c.peek) == 2:
+		return nil, nil
+	case len(c.peek) < 2, c.ProtocolLevel != 5:
+		return nil, fmt.Errorf("%w: %s with %d byte remaining length", ErrProtocol, name, len(c.peek))
+	}
+
+	reasonCode := c.peek[2]
+	var reason string
+	if len(c.peek) > 3 {
+		_, err := eachProperty(c.peek[3:], func(id byte, value []byte) {
+			if id == propReasonString {
+				reason = string(value)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reasonCode < 0x80 {
+		return nil, nil
+	}
+	return &brokerFailure{name, reasonCode, reason}, nil
+}
+
+// BrokerFailure is an acknowledgement with a reason code from 0x80.
+type brokerFailure struct {
+	name       string // packet type
+	reasonCode byte
+	reason     string // optional
+}
+
+// Error implements the standard error interface.
+func (f *brokerFailure) Error() string {
+	if f.reason != "" {
+		return fmt.Sprintf("mqtt: broker failed with %s reason code %#02x; %s", f.name, f.reasonCode, f.reason)
+	}
+	return fmt.Sprintf("mqtt: broker failed with %s reason code %#02x", f.name, f.reasonCode)
 }
 
 // OnPUBREC applies the first confirm of a PublishExactlyOnce.
 func (c *Client) onPUBREC() error {
 	// parse packet
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: PUBREC with %d byte remaining length", errProtoReset, len(c.peek))
+	failure, err := c.ackFailure("PUBREC")
+	if err != nil {
+		return err
 	}
 	packetID := uint(binary.BigEndian.Uint16(c.peek))
 
@@ -638,14 +1503,50 @@ func (c *Client) onPUBREC() error {
 	case packetID&^publishIDMask != exactlyOnceIDSpace:
 		return errPacketIDSpace
 	case packetID != expect:
-		return fmt.Errorf("%w: PUBREC %#04x while %#04x next in line", errProtoReset, packetID, expect)
+		return fmt.Errorf("%w: PUBREC %#04x while %#04x next in line", ErrProtocol, packetID, expect)
 	case int(c.Received-c.Completed) >= len(c.exactlyOnceQ):
-		return fmt.Errorf("%w: PUBREC precedes PUBLISH", errProtoReset)
+		return fmt.Errorf("%w: PUBREC precedes PUBLISH", ErrProtocol)
+	}
+
+	if failure != nil {
+		// The exchange ends without PUBREL. Any PUBCOMP pending
+		// for a predecessor must complete first, as the queue is
+		// in order.
+		if c.orderedTxs.Completed != c.orderedTxs.Received {
+			// A PUBREL in Persistence causes a PUBCOMP with
+			// failure from the broker after a restart.
+			c.pendingAck = append(c.pendingAck[:0], typePUBREL<<4|atLeastOnceLevel<<1, 2, byte(packetID>>8), byte(packetID))
+			err := c.persistence.Save(packetID, net.Buffers{c.pendingAck})
+			c.pendingAck = c.pendingAck[:0]
+			if err != nil {
+				return err // causes resubmission of PUBLISH
+			}
+			c.orderedTxs.Received++
+			if c.exactlyOnceFailed == nil {
+				c.exactlyOnceFailed = make(map[uint]error)
+			}
+			c.exactlyOnceFailed[packetID] = failure
+			return nil
+		}
+		err := c.persistence.Delete(packetID)
+		if err != nil {
+			return err // causes resubmission of PUBLISH
+		}
+		c.orderedTxs.Received++
+		c.orderedTxs.Completed++
+		if c.OnFree != nil {
+			c.OnFree(packetID)
+		}
+		endExchange(<-c.exactlyOnceQ, failure)
+		c.windowFree()
+		c.drainNotify()
+		c.queueTimes.pop(&c.queueTimes.exactlyOnce)
+		return c.resendHeld()
 	}
 
 	// Use pendingAck as a buffer here.
 	c.pendingAck = append(c.pendingAck[:0], typePUBREL<<4|atLeastOnceLevel<<1, 2, byte(packetID>>8), byte(packetID))
-	err := c.persistence.Save(packetID, net.Buffers{c.pendingAck})
+	err = c.persistence.Save(packetID, net.Buffers{c.pendingAck})
 	if err != nil {
 		c.pendingAck = c.pendingAck[:0]
 		return err // causes resubmission of PUBLISH (from persistence)
@@ -663,8 +1564,9 @@ func (c *Client) onPUBREC() error {
 // OnPUBCOMP applies the second (and final) confirm of a PublishExactlyOnce.
 func (c *Client) onPUBCOMP() error {
 	// parse packet
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: PUBCOMP with %d byte remaining length", errProtoReset, len(c.peek))
+	failure, err := c.ackFailure("PUBCOMP")
+	if err != nil {
+		return err
 	}
 	packetID := uint(binary.BigEndian.Uint16(c.peek))
 
@@ -676,21 +1578,94 @@ func (c *Client) onPUBCOMP() error {
 	case packetID&^publishIDMask != exactlyOnceIDSpace:
 		return errPacketIDSpace
 	case packetID != expect:
-		return fmt.Errorf("%w: PUBCOMP %#04x while %#04x next in line", errProtoReset, packetID, expect)
+		return fmt.Errorf("%w: PUBCOMP %#04x while %#04x next in line", ErrProtocol, packetID, expect)
 	case c.orderedTxs.Completed >= c.orderedTxs.Received || len(c.exactlyOnceQ) == 0:
-		return fmt.Errorf("%w: PUBCOMP precedes PUBREL", errProtoReset)
+		return fmt.Errorf("%w: PUBCOMP precedes PUBREL", ErrProtocol)
 	}
 
 	// ceil transaction
-	err := c.persistence.Delete(packetID)
+	err = c.persistence.Delete(packetID)
 	if err != nil {
 		return err // causes resubmission of PUBREL (from Persistence)
 	}
 	c.orderedTxs.Completed++
-	close(<-c.exactlyOnceQ)
+	if c.OnFree != nil {
+		c.OnFree(packetID)
+	}
+	endExchange(<-c.exactlyOnceQ, failure)
+	c.windowFree()
+	c.drainNotify()
+	c.queueTimes.pop(&c.queueTimes.exactlyOnce)
+	if err := c.resendHeld(); err != nil {
+		return err
+	}
+
+	// end failures from PUBREC which are next in line
+	for c.orderedTxs.Completed != c.orderedTxs.Received {
+		packetID := c.orderedTxs.Completed&publishIDMask | exactlyOnceIDSpace
+		failure, ok := c.exactlyOnceFailed[packetID]
+		if !ok {
+			break
+		}
+		err := c.persistence.Delete(packetID)
+		if err != nil {
+			return err
+		}
+		delete(c.exactlyOnceFailed, packetID)
+		c.orderedTxs.Completed++
+		if c.OnFree != nil {
+			c.OnFree(packetID)
+		}
+		endExchange(<-c.exactlyOnceQ, failure)
+		c.windowFree()
+		c.drainNotify()
+		c.queueTimes.pop(&c.queueTimes.exactlyOnce)
+		if err := c.resendHeld(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// RandomClientID returns 23 random characters from [0-9a-zA-Z], which brokers
+// must accept as a client identifier.
+// “The Server MUST allow ClientIds which are between 1 and 23 UTF-8 encoded
+// bytes in length, and that contain only the characters
+// "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ".”
+// — MQTT Version 3.1.1, conformance statement MQTT-3.1.3-5
+//
+// The characters come from crypto/rand. When the system fails to provide
+// cryptographic random, then RandomClientID falls back to math/rand, seeded
+// with the current time and the process identifier. Such identifiers are less
+// likely to be unique, yet they do not crash the process.
+func RandomClientID() string {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	var buf [23]byte
+	var random [32]byte
+	var fallback *mathrand.Rand // lazy initiation
+	for i := 0; i < len(buf); {
+		if _, err := rand.Read(random[:]); err != nil {
+			if fallback == nil {
+				seed := time.Now().UnixNano() ^ int64(os.Getpid())<<32
+				fallback = mathrand.New(mathrand.NewSource(seed))
+			}
+			fallback.Read(random[:])
+		}
+		for _, b := range random {
+			// reject the remainder to prevent modulo bias
+			if int(b) >= 256/len(chars)*len(chars) {
+				continue
+			}
+			buf[i] = chars[int(b)%len(chars)]
+			i++
+			if i == len(buf) {
+				break
+			}
+		}
+	}
+	return string(buf[:])
+}
+
 // InitSession configures the Persistence for first use. Brokers use clientID to
 // uniquely identify the session. The session may be continued with AdoptSession
 // on another Client.
@@ -703,6 +1678,17 @@ func InitSession(clientID string, p Persistence, c *Config) (*Client, error) {
 // without the “exactly once” guarantee [SubscribeLimitAtLeastOnce], and for
 // testing.
 //
+// Delivery guarantees hold only for as long as the session state does.
+//
+//	                 │ VolatileSession │ InitSession & AdoptSession
+//	─────────────────┼─────────────────┼───────────────────────────
+//	at most once     │ no state        │ no state
+//	at least once    │ lost on exit    │ survives restarts
+//	exactly once     │ lost on exit    │ survives restarts
+//
+// The first PublishAtLeastOnce or PublishExactlyOnce [including the retained
+// variants] on a volatile session issues a Config.Warn.
+//
 // Brokers use clientID to uniquely identify the session. Volatile sessions may
 // be continued by using the same clientID again. Use CleanSession to prevent
 // reuse of an existing state.
@@ -711,6 +1697,9 @@ func VolatileSession(clientID string, c *Config) (*Client, error) {
 }
 
 func initSession(clientID string, p Persistence, c *Config) (*Client, error) {
+	if clientID == "" && c.ClientIDGenerator != nil {
+		clientID = c.ClientIDGenerator()
+	}
 	if err := stringCheck(clientID); err != nil {
 		return nil, fmt.Errorf("mqtt: illegal client identifier: %w", err)
 	}
@@ -736,6 +1725,43 @@ func initSession(clientID string, p Persistence, c *Config) (*Client, error) {
 	return newClient(p, c), nil
 }
 
+// PersistentSession either continues with the session in Persistence, or it
+// initiates a new one when Persistence is empty. The session must match the
+// clientID, except for an empty clientID with a Config.ClientIDGenerator, as
+// the generated identifier is persisted. Persistent sessions can't have
+// CleanSession set. Fatal errors leave Persistence as is. See AdoptSession for
+// the warnings.
+func PersistentSession(clientID string, p Persistence, c *Config) (client *Client, warn []error, fatal error) {
+	if p == nil {
+		return nil, nil, errors.New("mqtt: persistent session without Persistence")
+	}
+	if c.CleanSession {
+		return nil, nil, errors.New("mqtt: persistent session with CleanSession")
+	}
+
+	keys, err := p.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 {
+		client, err := InitSession(clientID, p, c)
+		return client, nil, err
+	}
+
+	value, err := (&ruggedPersistence{Persistence: p}).Load(clientIDKey)
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case value == nil:
+		return nil, nil, errors.New("mqtt: persistence without client identifier")
+	case clientID == "" && c.ClientIDGenerator != nil:
+		break // generated before
+	case string(value) != clientID:
+		return nil, nil, fmt.Errorf("mqtt: persistence has client identifier %q, want %q", value, clientID)
+	}
+	return AdoptSession(p, c)
+}
+
 // AdoptSession continues with a Persistence which had an InitSession already.
 func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal error) {
 	if err := c.valid(); err != nil {
@@ -807,6 +1833,8 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 		return nil, warn, fmt.Errorf("mqtt: %d ExactlyOnceMax is less than %d pending from Persistence", c.ExactlyOnceMax, len(exactlyOnceKeys))
 	}
 	client = newClient(&ruggedPersistence{Persistence: p}, c)
+	// submission time of pending requests unknown
+	adoptTime := time.Now()
 
 	// “When a Client reconnects with CleanSession set to 0, both the Client
 	// and Server MUST re-send any unacknowledged PUBLISH Packets (where QoS
@@ -816,7 +1844,8 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 	if len(atLeastOnceKeys) != 0 {
 		client.orderedTxs.Acked = atLeastOnceKeys[0] & publishIDMask
 		for range atLeastOnceKeys {
-			client.atLeastOnceQ <- make(chan<- error, 1) // won't block due Max check above
+			client.atLeastOnceQ <- newExchange() // won't block due Max check above
+			client.queueTimes.push(&client.queueTimes.atLeastOnce, adoptTime)
 		}
 		<-client.atLeastOnceSem
 		client.atLeastOnceBlock <- holdup{
@@ -828,7 +1857,8 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 	if len(exactlyOnceKeys) != 0 {
 		client.orderedTxs.Completed = exactlyOnceKeys[0] & publishIDMask
 		for range exactlyOnceKeys {
-			client.exactlyOnceQ <- make(chan<- error, 1) // won't block due Max check above
+			client.exactlyOnceQ <- newExchange() // won't block due Max check above
+			client.queueTimes.push(&client.queueTimes.exactlyOnce, adoptTime)
 		}
 		var pubN int
 		for i, key := range exactlyOnceKeys {
@@ -841,7 +1871,7 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 			// send all those 4-byte packets in one batch
 			client.pendingAck = append(client.pendingAck, packet...)
 		}
-		if client.orderedTxs.Received == 0 {
+		if pubN == 0 { // all released
 			client.orderedTxs.Received = exactlyOnceKeys[len(exactlyOnceKeys)-1]&publishIDMask + 1
 		}
 		<-client.exactlyOnceSem
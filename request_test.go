@@ -1,11 +1,15 @@
 package mqtt_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -70,6 +74,212 @@ func TestSubscribeMultiple(t *testing.T) {
 	<-brokerMockDone
 }
 
+func TestSubscribeDowngrade(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "82096000000478797a7a02") // SUBSCRIBE
+		sendPacketHex(t, conn, "9003600001")             // SUBACK
+	})
+
+	err := client.Subscribe(nil, "xyzz")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+
+	if got := client.Stats().SubscribeDowngrades; got != 1 {
+		t.Errorf("got %d subscribe downgrades, want 1", got)
+	}
+}
+
+// A SUBACK with more return codes than topic filters must not count any
+// downgrades.
+func TestSubscribeDowngradeCount(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: mqtt.ErrProtocol})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[0], "82096000000478797a7a02") // SUBSCRIBE
+		sendPacketHex(t, conns[0], "900460000100")           // SUBACK
+		// reconnect on protocol error
+		wantPacketHex(t, conns[1], pipeCONNECTHex)
+		sendPacketHex(t, conns[1], "20020000") // CONNACK
+	})
+
+	err := client.Subscribe(nil, "xyzz")
+	if err == nil {
+		t.Error("subscribe got no error for 2 return codes on 1 topic filter")
+	}
+	<-brokerMockDone
+
+	if got := client.Stats().SubscribeDowngrades; got != 0 {
+		t.Errorf("got %d subscribe downgrades, want 0", got)
+	}
+}
+
+func TestSubscribeLevels(t *testing.T) {
+	const filterN = 10
+	filters := make([]string, filterN)
+	levels := make([]byte, filterN)
+	for i := range filters {
+		filters[i] = fmt.Sprintf("topic/%02d", i)
+		levels[i] = byte(i % 3)
+	}
+
+	// 2 + 10 * (2 + 8 + 1) = 112 remaining length
+	want := []byte{0x82, 112, 0x60, 0x00}
+	suback := []byte{0x90, filterN + 2, 0x60, 0x00}
+	for i, s := range filters {
+		want = append(want, 0, byte(len(s)))
+		want = append(want, s...)
+		want = append(want, levels[i])
+		suback = append(suback, levels[i])
+	}
+	suback[len(suback)-1] = 0x80 // failure on last
+
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString(want))
+		sendPacketHex(t, conn, hex.EncodeToString(suback))
+	})
+
+	granted, err := client.SubscribeLevels(nil, filters, levels)
+	<-brokerMockDone
+	var failed mqtt.SubscribeError
+	if !errors.As(err, &failed) || len(failed) != 1 || failed[0] != filters[filterN-1] {
+		t.Errorf("got error %q [%T], want SubscribeError with %q only", err, err, filters[filterN-1])
+	}
+	if !bytes.Equal(granted, suback[4:]) {
+		t.Errorf("got granted levels %#x, want %#x", granted, suback[4:])
+	}
+}
+
+func TestSubscribeWithOptions(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		ProtocolLevel: 5,
+		Dialer:        newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	sendPacketHex(t, brokerEnd, "2003000000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "820b600000"+"0001612d"+"00016200")
+		sendPacketHex(t, brokerEnd, "9005600000"+"0100") // SUBACK
+	})
+	granted, err := client.SubscribeWithOptions(nil, []string{"a", "b"}, []mqtt.SubscribeOptions{
+		{LevelMax: 1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+		{},
+	})
+	<-brokerMockDone
+	if err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+	if !bytes.Equal(granted, []byte{1, 0}) {
+		t.Errorf("got granted levels %#x, want 0x0100", granted)
+	}
+
+	_, err = client.SubscribeWithOptions(nil, []string{"a"}, []mqtt.SubscribeOptions{{RetainHandling: 3}})
+	if !mqtt.IsDeny(err) {
+		t.Errorf("subscribe with retain handling 3 got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+}
+
+func TestPublishWithOptions(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ProtocolLevel:  5,
+		AtLeastOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	sendPacketHex(t, brokerEnd, "2003000000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "3118000174"+"12"+"020000003c"+"03000a746578742f706c61696e"+"6869")
+	})
+	err = client.PublishWithOptions(nil, []byte("hi"), "t", mqtt.PublishOptions{
+		Retain:        true,
+		MessageExpiry: 60,
+		ContentType:   "text/plain",
+	})
+	<-brokerMockDone
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "320d0001748000"+"050200000001"+"6869")
+		sendPacketHex(t, brokerEnd, "40028000") // PUBACK
+	})
+	exchange, err := client.PublishAtLeastOnceWithOptions([]byte("hi"), "t", mqtt.PublishOptions{MessageExpiry: 1})
+	if err != nil {
+		t.Fatal("publish at least once error:", err)
+	}
+	<-brokerMockDone
+	select {
+	case err, ok := <-exchange:
+		if ok {
+			t.Error("exchange error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exchange timeout")
+	}
+}
+
+func TestExportSubscriptions(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "820e6000"+"0003612f2b01"+"0003622f2301")
+		sendPacketHex(t, conn, "900460000180") // SUBACK
+	})
+	err := client.SubscribeLimitAtLeastOnce(nil, "a/+", "b/#")
+	<-brokerMockDone
+	var failed mqtt.SubscribeError
+	if !errors.As(err, &failed) || len(failed) != 1 || failed[0] != "b/#" {
+		t.Fatalf("got subscribe error %v, want a SubscribeError for \"b/#\" only", err)
+	}
+	exported := client.ExportSubscriptions()
+	want := []mqtt.Subscription{{TopicFilter: "a/+", SubscribeOptions: mqtt.SubscribeOptions{LevelMax: 1}}}
+	if len(exported) != len(want) || exported[0] != want[0] {
+		t.Fatalf("got exported subscriptions %+v, want %+v", exported, want)
+	}
+
+	// import into another Client
+	clientEnd, brokerEnd := net.Pipe()
+	client2, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	err = client2.ImportSubscriptions([]mqtt.Subscription{{TopicFilter: "a/#/b"}})
+	if !mqtt.IsDeny(err) {
+		t.Errorf("import of illegal topic filter got error %v, want an mqtt.IsDeny", err)
+	}
+	if err := client2.ImportSubscriptions(exported); err != nil {
+		t.Fatal("import error:", err)
+	}
+	testClient(t, client2)
+	wantPacketHex(t, brokerEnd, pipeCONNECTHex)
+	sendPacketHex(t, brokerEnd, "20020000") // CONNACK
+	wantPacketHex(t, brokerEnd, "82086000"+"0003612f2b01")
+	sendPacketHex(t, brokerEnd, "9003600001") // SUBACK
+}
+
 func TestSubscribeReqTimeout(t *testing.T) {
 	client, conn := newClientPipe(t)
 	brokerMockDone := testRoutine(t, func() {
@@ -147,6 +357,144 @@ func TestPublish(t *testing.T) {
 	<-brokerMockDone
 }
 
+func TestPublishJSON(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x30, 16,
+			0, 4, 't', 'e', 'm', 'p',
+			'{', '"', 'C', '"', ':', '2', '0', '.', '8', '}'}))
+	})
+
+	err := client.PublishJSON(nil, struct{ C float64 }{20.8}, "temp")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+
+	err = client.PublishJSON(nil, func() {}, "temp")
+	if err == nil {
+		t.Error("got no error for function value")
+	}
+}
+
+func TestPublishJSON5(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ProtocolLevel:  5,
+		AtLeastOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	sendPacketHex(t, brokerEnd, "2003000000") // CONNACK
+
+	const contentTypeHex = "030010" + "6170706c69636174696f6e2f6a736f6e" // application/json
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "3018000174"+"13"+contentTypeHex+"31")
+	})
+	err = client.PublishJSON(nil, 1, "t")
+	<-brokerMockDone
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "321a0001748000"+"13"+contentTypeHex+"32")
+		sendPacketHex(t, brokerEnd, "40028000") // PUBACK
+	})
+	exchange, err := client.PublishAtLeastOnceJSON(2, "t")
+	if err != nil {
+		t.Fatal("publish at least once error:", err)
+	}
+	<-brokerMockDone
+	testAck(t, exchange)
+
+	if _, err := client.PublishExactlyOnceJSON(func() {}, "t"); err == nil {
+		t.Error("publish exactly once got no error for function value")
+	}
+}
+
+func TestPublishFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(name, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x30, 12,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			'h', 'e', 'l', 'l', 'o'}))
+	})
+
+	err := client.PublishFile(nil, name, "greet")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0x80, 0x00, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+		sendPacketHex(t, conn, "40028000") // PUBACK
+	})
+	exchange, err := client.PublishAtLeastOnceFile(name, "greet")
+	if err != nil {
+		t.Fatalf("publish at least once got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	testAck(t, exchange)
+
+	err = client.PublishFile(nil, name+".absent", "greet")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v for absent file, want an os.ErrNotExist", err)
+	}
+
+	// sparse file exceeds the packet size limit
+	big := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(big, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(big, 256<<20); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.PublishExactlyOnceFile(big, "greet")
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("got error %v for big file, want a denial", err)
+	}
+}
+
+func TestClearRetained(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x31, 7,
+			0, 5, 'g', 'r', 'e', 'e', 't'}))
+	})
+
+	err := client.ClearRetained(nil, "greet")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+
+	err = client.ClearRetained(nil, "greet/#")
+	if !mqtt.IsDeny(err) {
+		t.Errorf("clear with wildcard got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+}
+
 func TestPublishReqTimeout(t *testing.T) {
 	client, conn := newClientPipe(t)
 	testRoutine(t, func() {
@@ -186,6 +534,414 @@ func TestPublishAtLeastOnce(t *testing.T) {
 	<-brokerMockDone
 }
 
+func TestWindowAvailable(t *testing.T) {
+	client, conn := newClientPipe(t)
+	select {
+	case <-client.WindowAvailable():
+		break
+	default:
+		t.Error("window signal blocked on initial state")
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "320700017480007831")
+		wantPacketHex(t, conn, "320700017480017832")
+	})
+	ack1, err := client.PublishAtLeastOnce([]byte("x1"), "t")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	ack2, err := client.PublishAtLeastOnce([]byte("x2"), "t")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	<-brokerMockDone
+
+	_, err = client.PublishAtLeastOnce([]byte("x3"), "t")
+	if !errors.Is(err, mqtt.ErrMax) {
+		t.Fatalf("publish beyond AtLeastOnceMax got error %v, want an ErrMax", err)
+	}
+	window := client.WindowAvailable()
+	select {
+	case <-window:
+		t.Fatal("window signal released after ErrMax")
+	default:
+		break
+	}
+
+	sendPacketHex(t, conn, "40028000") // PUBACK
+	select {
+	case <-window:
+		break
+	case <-time.After(time.Second):
+		t.Fatal("window signal blocked after PUBACK")
+	}
+	testAck(t, ack1)
+	select {
+	case err := <-ack2:
+		t.Errorf("second publish got exchange error %v before PUBACK", err)
+	default:
+		break
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	client, conn := newClientPipe(t)
+	if inUse, limit := client.InFlight(); inUse != 0 || limit != 4 {
+		t.Errorf("got %d in flight with limit %d, want 0 and 4", inUse, limit)
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "320700017480007831")
+	})
+	ack, err := client.PublishAtLeastOnce([]byte("x1"), "t")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	<-brokerMockDone
+	if inUse, limit := client.InFlight(); inUse != 1 || limit != 4 {
+		t.Errorf("got %d in flight with limit %d after publish, want 1 and 4", inUse, limit)
+	}
+
+	sendPacketHex(t, conn, "40028000") // PUBACK
+	testAck(t, ack)
+	if inUse, limit := client.InFlight(); inUse != 0 || limit != 4 {
+		t.Errorf("got %d in flight with limit %d after PUBACK, want 0 and 4", inUse, limit)
+	}
+}
+
+func TestPublishAtLeastOnceBlocking(t *testing.T) {
+	client, conn := newClientPipe(t)
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "320700017480007831")
+		wantPacketHex(t, conn, "320700017480017832")
+	})
+	for _, message := range []string{"x1", "x2"} {
+		_, err := client.PublishAtLeastOnceBlocking(nil, []byte(message), "t")
+		if err != nil {
+			t.Fatal("publish error:", err)
+		}
+	}
+	<-brokerMockDone
+
+	quit := make(chan struct{})
+	close(quit)
+	_, err := client.PublishAtLeastOnceBlocking(quit, []byte("x3"), "t")
+	if !errors.Is(err, mqtt.ErrCanceled) {
+		t.Fatalf("publish beyond AtLeastOnceMax with quit got error %v, want an ErrCanceled", err)
+	}
+
+	publishDone := testRoutine(t, func() {
+		_, err := client.PublishAtLeastOnceBlocking(nil, []byte("x3"), "t")
+		if err != nil {
+			t.Error("publish after PUBACK got error:", err)
+		}
+	})
+	// PUBACK may precede the submission attempt or not
+	sendPacketHex(t, conn, "40028000") // PUBACK
+	wantPacketHex(t, conn, "320700017480027833")
+	<-publishDone
+
+	// window full again
+	publishDone = testRoutine(t, func() {
+		_, err := client.PublishAtLeastOnceBlocking(nil, []byte("x4"), "t")
+		if !errors.Is(err, mqtt.ErrClosed) {
+			t.Errorf("publish during close got error %v, want an ErrClosed", err)
+		}
+	})
+	// Close may precede the submission attempt or not
+	if err := client.Close(); err != nil {
+		t.Error("close error:", err)
+	}
+	<-publishDone
+}
+
+func TestPublishWait(t *testing.T) {
+	client, conn := newClientPipe(t)
+
+	quit := make(chan struct{})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "320700017480007831")
+		sendPacketHex(t, conn, "40028000") // PUBACK
+		wantPacketHex(t, conn, "3407000174c0007832")
+		sendPacketHex(t, conn, "5002c000") // PUBREC
+		wantPacketHex(t, conn, "6202c000") // PUBREL
+		sendPacketHex(t, conn, "7002c000") // PUBCOMP
+		wantPacketHex(t, conn, "320700017480017833")
+		close(quit) // instead of PUBACK
+	})
+	if err := client.PublishAtLeastOnceWait(nil, []byte("x1"), "t"); err != nil {
+		t.Error("publish at least once error:", err)
+	}
+	if err := client.PublishExactlyOnceWait(nil, []byte("x2"), "t"); err != nil {
+		t.Error("publish exactly once error:", err)
+	}
+
+	// no PUBACK
+	err := client.PublishAtLeastOnceWait(quit, []byte("x3"), "t")
+	if !errors.Is(err, mqtt.ErrCanceled) {
+		t.Errorf("publish without PUBACK got error %v, want an ErrCanceled", err)
+	}
+	<-brokerMockDone
+}
+
+func TestPublishWaitResend(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[0], "320700017480007831")
+		if err := conns[0].Close(); err != nil {
+			t.Fatal("broker got error on first connection close:", err)
+		}
+
+		wantPacketHex(t, conns[1], pipeCONNECTHex)
+		sendPacketHex(t, conns[1], "20020000")           // CONNACK
+		wantPacketHex(t, conns[1], "3a0700017480007831") // with DUP flag
+		sendPacketHex(t, conns[1], "40028000")           // PUBACK
+	})
+	// the connection reset does not end the wait
+	if err := client.PublishAtLeastOnceWait(nil, []byte("x1"), "t"); err != nil {
+		t.Error("publish at least once error:", err)
+	}
+	<-brokerMockDone
+}
+
+func TestPublishWaitFailure(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ProtocolLevel:  5,
+		AtLeastOnceMax: 1,
+		Dialer:         newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	sendPacketHex(t, brokerEnd, "2003000000") // CONNACK
+	<-client.Online()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "3208000174"+"8000"+"00"+"6869")
+		sendPacketHex(t, brokerEnd, "4003800087") // PUBACK not authorized
+	})
+	err = client.PublishAtLeastOnceWait(nil, []byte("hi"), "t")
+	if err == nil || !strings.Contains(err.Error(), "0x87") {
+		t.Errorf("got error %v, want the reason code 0x87", err)
+	}
+	<-brokerMockDone
+}
+
+func TestReceiveMax(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ProtocolLevel:  5,
+		AtLeastOnceMax: 2,
+		ExactlyOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	// CONNACK with a Receive Maximum of 1
+	sendPacketHex(t, brokerEnd, "20060000"+"03210001")
+	<-client.Online()
+	if _, limit := client.InFlight(); limit != 1 {
+		t.Errorf("got in-flight limit %d, want the Receive Maximum of 1", limit)
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "3208000174"+"8000"+"00"+"6869")
+	})
+	ack, err := client.PublishAtLeastOnce([]byte("hi"), "t")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	<-brokerMockDone
+
+	_, err = client.PublishExactlyOnce([]byte("hi"), "t")
+	if !errors.Is(err, mqtt.ErrMax) {
+		t.Fatalf("publish beyond Receive Maximum got error %v, want an ErrMax", err)
+	}
+	window := client.WindowAvailable()
+
+	sendPacketHex(t, brokerEnd, "40028000") // PUBACK
+	select {
+	case <-window:
+		break
+	case <-time.After(time.Second):
+		t.Fatal("window signal blocked after PUBACK")
+	}
+	testAck(t, ack)
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "3408000174"+"c000"+"00"+"6869")
+	})
+	_, err = client.PublishExactlyOnce([]byte("hi"), "t")
+	if err != nil {
+		t.Fatal("publish after PUBACK got error:", err)
+	}
+	<-brokerMockDone
+}
+
+// Resends on reconnect must stay within the Receive Maximum from the new
+// CONNACK. The remainder follows on acknowledgement.
+func TestPUBRECFailureInLine(t *testing.T) {
+	t.Parallel()
+
+	clientEnd, brokerEnd := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ProtocolLevel:  5,
+		ExactlyOnceMax: 3,
+		Dialer:         newTestDialer(t, clientEnd),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerEnd, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	sendPacketHex(t, brokerEnd, "2003000000") // CONNACK
+	<-client.Online()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "3407000174"+"c000"+"00"+"31")
+		wantPacketHex(t, brokerEnd, "3407000174"+"c001"+"00"+"32")
+		sendPacketHex(t, brokerEnd, "5002c000")   // PUBREC
+		wantPacketHex(t, brokerEnd, "6202c000")   // PUBREL
+		sendPacketHex(t, brokerEnd, "5003c00180") // PUBREC unspecified error
+	})
+	exchange1, err := client.PublishExactlyOnce([]byte("1"), "t")
+	if err != nil {
+		t.Fatal("publish #1 error:", err)
+	}
+	exchange2, err := client.PublishExactlyOnce([]byte("2"), "t")
+	if err != nil {
+		t.Fatal("publish #2 error:", err)
+	}
+	<-brokerMockDone
+
+	// failure ends after the PUBCOMP of its predecessor
+	sendPacketHex(t, brokerEnd, "7002c000") // PUBCOMP
+	testAck(t, exchange1)
+	select {
+	case err, ok := <-exchange2:
+		if !ok || err == nil || !strings.Contains(err.Error(), "0x80") {
+			t.Errorf("exchange #2 got error %v, want reason code 0x80", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exchange #2 timeout")
+	}
+	if _, ok := <-exchange2; ok {
+		t.Error("exchange #2 not closed after failure")
+	}
+
+	// connection remains in use
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd, "3407000174"+"c002"+"00"+"33")
+		sendPacketHex(t, brokerEnd, "5002c002") // PUBREC
+		wantPacketHex(t, brokerEnd, "6202c002") // PUBREL
+		sendPacketHex(t, brokerEnd, "7002c002") // PUBCOMP
+	})
+	exchange3, err := client.PublishExactlyOnce([]byte("3"), "t")
+	if err != nil {
+		t.Fatal("publish #3 error:", err)
+	}
+	<-brokerMockDone
+	testAck(t, exchange3)
+}
+
+func TestReceiveMaxResend(t *testing.T) {
+	t.Parallel()
+
+	clientEnd1, brokerEnd1 := net.Pipe()
+	clientEnd2, brokerEnd2 := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ProtocolLevel:  5,
+		AtLeastOnceMax: 2,
+		ExactlyOnceMax: 2,
+		Dialer:         newTestDialer(t, clientEnd1, clientEnd2),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client, mqtttest.Transfer{Err: io.EOF})
+
+	wantPacketHex(t, brokerEnd1, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	sendPacketHex(t, brokerEnd1, "2003000000") // CONNACK
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerEnd1, "3207000174"+"8000"+"00"+"31")
+		wantPacketHex(t, brokerEnd1, "3407000174"+"c000"+"00"+"32")
+		brokerEnd1.Close()
+	})
+	exchange1, err := client.PublishAtLeastOnce([]byte("1"), "t")
+	if err != nil {
+		t.Fatal("publish at least once error:", err)
+	}
+	exchange2, err := client.PublishExactlyOnce([]byte("2"), "t")
+	if err != nil {
+		t.Fatal("publish exactly once error:", err)
+	}
+	<-brokerMockDone
+
+	wantPacketHex(t, brokerEnd2, "101200044d51545405000000"+"0511ffffffff"+"0000")
+	// CONNACK with session present and a Receive Maximum of 1
+	sendPacketHex(t, brokerEnd2, "20060100"+"03210001")
+	wantPacketHex(t, brokerEnd2, "3a07000174"+"8000"+"00"+"31")
+	// exactly once on hold until PUBACK
+	sendPacketHex(t, brokerEnd2, "40028000") // PUBACK
+	wantPacketHex(t, brokerEnd2, "3c07000174"+"c000"+"00"+"32")
+	sendPacketHex(t, brokerEnd2, "5002c000") // PUBREC
+	wantPacketHex(t, brokerEnd2, "6202c000") // PUBREL
+	sendPacketHex(t, brokerEnd2, "7002c000") // PUBCOMP
+
+	for _, exchange := range []<-chan error{exchange1, exchange2} {
+		if err := <-exchange; !errors.Is(err, mqtt.ErrDown) {
+			t.Errorf("exchange got error %v, want an ErrDown on the connection loss", err)
+		}
+		testAck(t, exchange)
+	}
+}
+
+func TestPublishAtLeastOnceTracked(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0x80, 0x00, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0x80, 0x01, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+		sendPacketHex(t, conn, "40028000") // PUBACK
+		sendPacketHex(t, conn, "40028001") // PUBACK
+	})
+
+	for _, want := range []uint{0x8000, 0x8001} {
+		packetID, ack, err := client.PublishAtLeastOnceTracked([]byte("hello"), "greet")
+		if err != nil {
+			t.Fatalf("got error %q [%T]", err, err)
+		}
+		if packetID != want {
+			t.Errorf("got packet identifier %#04x, want %#04x", packetID, want)
+		}
+		defer testAck(t, ack)
+	}
+	<-brokerMockDone
+}
+
 func TestPublishAtLeastOnceReqTimeout(t *testing.T) {
 	client, conn := newClientPipe(t)
 	brokerMockDone := testRoutine(t, func() {
@@ -244,7 +1000,10 @@ func TestPublishAtLeastOnceResend(t *testing.T) {
 
 	ack, err := client.PublishAtLeastOnce([]byte{'x'}, "y")
 	if err != nil {
-		t.Errorf("got error %q [%T]", err, err)
+		t.Fatalf("got error %q [%T]", err, err)
+	}
+	if err := <-ack; !errors.Is(err, mqtt.ErrDown) {
+		t.Errorf("got ack error %q, want an ErrDown on the connection reset", err)
 	}
 	testAck(t, ack)
 	<-brokerMockDone
@@ -344,6 +1103,130 @@ func TestPublishAtLeastOnceRestart(t *testing.T) {
 	sendPacketHex(t, brokerConn, "40028002") // SUBACK 3rd
 }
 
+func TestPersistentSession(t *testing.T) {
+	t.Parallel()
+
+	p := mqtt.FileSystem(t.TempDir())
+
+	clientConn, brokerConn := net.Pipe()
+	client, warn, err := mqtt.PersistentSession("test-client", p, &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ExactlyOnceMax: 1,
+		Dialer:         newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("PersistentSession error:", err)
+	}
+	for _, err := range warn {
+		t.Error("PersistentSession warning:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, hex.EncodeToString([]byte{
+			0x34, 6,
+			0, 1, 'x',
+			0xc0, 0x00, // packet identifier
+			'1'}))
+		// no PUBREC
+		err := client.Close()
+		if err != nil {
+			t.Error("Close error:", err)
+		}
+	})
+	ack, err := client.PublishExactlyOnce([]byte{'1'}, "x")
+	if err != nil {
+		t.Errorf("publish got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	testAckClosed(t, ack)
+
+	_, _, err = mqtt.PersistentSession("other-client", p, &mqtt.Config{
+		ExactlyOnceMax: 1,
+		Dialer:         newTestDialer(t),
+	})
+	if err == nil {
+		t.Error("PersistentSession with another client identifier got no error")
+	}
+
+	// resume
+	clientConn, brokerConn = net.Pipe()
+	client, warn, err = mqtt.PersistentSession("test-client", p, &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ExactlyOnceMax: 1,
+		Dialer:         newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("PersistentSession resume error:", err)
+	}
+	for _, err := range warn {
+		t.Error("PersistentSession resume warning:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+	wantPacketHex(t, brokerConn, hex.EncodeToString([]byte{
+		0x3c, 6, // with duplicate [DUP] flag
+		0, 1, 'x',
+		0xc0, 0x00, // packet identifier
+		'1'}))
+	sendPacketHex(t, brokerConn, "5002c000") // PUBREC
+	wantPacketHex(t, brokerConn, "6202c000") // PUBREL
+	sendPacketHex(t, brokerConn, "7002c000") // PUBCOMP
+}
+
+func TestPublishAtLeastOncePersisted(t *testing.T) {
+	t.Parallel()
+
+	p := mqtt.FileSystem(t.TempDir())
+
+	clientConn, brokerConn := net.Pipe()
+	client, warn, err := mqtt.PersistentSession("test-client", p, &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		AtLeastOnceMax: 1,
+		Dialer:         newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("PersistentSession error:", err)
+	}
+	for _, err := range warn {
+		t.Error("PersistentSession warning:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "320600017880003f")
+	})
+	exchange, err := client.PublishAtLeastOnce([]byte{'?'}, "x")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	<-brokerMockDone
+
+	// persisted on return, and not confirmed yet
+	if value, err := p.Load(0x8000); err != nil {
+		t.Error("persistence load error:", err)
+	} else if value == nil {
+		t.Error("publish returned before persistence")
+	}
+	select {
+	case err, ok := <-exchange:
+		t.Errorf("exchange got error %v (open %t) before PUBACK", err, ok)
+	default:
+		break
+	}
+
+	sendPacketHex(t, brokerConn, "40028000") // PUBACK
+	testAck(t, exchange)
+	if value, err := p.Load(0x8000); err != nil || value != nil {
+		t.Errorf("persistence load after PUBACK got %#x, error %v, want nil", value, err)
+	}
+}
+
 func TestPublishExactlyOnce(t *testing.T) {
 	client, conn := newClientPipe(t)
 	brokerMockDone := testRoutine(t, func() {
@@ -509,6 +1392,18 @@ func TestDeny(t *testing.T) {
 	if !mqtt.IsDeny(err) {
 		t.Errorf("subscribe with nothing got error %q [%T], want an mqtt.IsDeny", err, err)
 	}
+	_, err = client.SubscribeLevels(nil, nil, nil)
+	if !mqtt.IsDeny(err) {
+		t.Errorf("subscribe levels with nothing got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+	_, err = client.SubscribeLevels(nil, []string{"a", "b"}, []byte{1})
+	if !mqtt.IsDeny(err) {
+		t.Errorf("subscribe levels with one level short got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+	_, err = client.SubscribeLevels(nil, []string{"a"}, []byte{3})
+	if !mqtt.IsDeny(err) {
+		t.Errorf("subscribe levels with level 3 got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
 	err = client.Unsubscribe(nil)
 	if !mqtt.IsDeny(err) {
 		t.Errorf("unsubscribe with nothing got error %q [%T], want an mqtt.IsDeny", err, err)
@@ -525,6 +1420,22 @@ func TestDeny(t *testing.T) {
 	if !mqtt.IsDeny(err) {
 		t.Errorf("publish with zero topic got error %q [%T], want an mqtt.IsDeny", err, err)
 	}
+	_, err = client.SubscribeWithOptions(nil, []string{"x"}, []mqtt.SubscribeOptions{{NoLocal: true}})
+	if !mqtt.IsDeny(err) {
+		t.Errorf("subscribe with no local on protocol level 4 got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+	err = client.PublishWithOptions(nil, nil, "x", mqtt.PublishOptions{MessageExpiry: 60})
+	if !mqtt.IsDeny(err) {
+		t.Errorf("publish with message expiry on protocol level 4 got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+	err = client.Subscribe(nil, "a/b#")
+	if !mqtt.IsDeny(err) {
+		t.Errorf("subscribe with misplaced wildcard got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+	err = client.Publish(nil, nil, "a/+")
+	if !mqtt.IsDeny(err) {
+		t.Errorf("publish with wildcard in topic got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
 
 	// size limits
 	tooBig := strings.Repeat("A", 1<<16)
@@ -532,6 +1443,14 @@ func TestDeny(t *testing.T) {
 	if !mqtt.IsDeny(err) {
 		t.Errorf("unsubscribe with 64 KiB filter got error %q [%T], want an mqtt.IsDeny", err, err)
 	}
+	err = client.Publish(nil, nil, tooBig)
+	if !mqtt.IsDeny(err) {
+		t.Errorf("publish with 64 KiB topic got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+	_, err = client.PublishAtLeastOnce(nil, tooBig)
+	if !mqtt.IsDeny(err) {
+		t.Errorf("publish at least once with 64 KiB topic got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
 	err = client.Publish(nil, make([]byte, 256*1024*1024), "")
 	if !mqtt.IsDeny(err) {
 		t.Errorf("publish with 256 MiB got error %q [%T], want an mqtt.IsDeny", err, err)
@@ -582,3 +1501,85 @@ func testAckClosed(t *testing.T, ack <-chan error) {
 		}
 	}
 }
+
+func TestVolatilePublishWarn(t *testing.T) {
+	var warns []error
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("dialer call not allowed for test")
+		},
+		AtLeastOnceMax: 2,
+		ExactlyOnceMax: 2,
+		Warn:           func(err error) { warns = append(warns, err) },
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	err = client.Publish(client.Offline(), []byte("x"), "y")
+	if !errors.Is(err, mqtt.ErrCanceled) {
+		t.Errorf("publish got error %q [%T], want an mqtt.ErrCanceled", err, err)
+	}
+	if len(warns) != 0 {
+		t.Fatalf("got warnings %q after publish at most once", warns)
+	}
+
+	if _, err := client.PublishAtLeastOnce([]byte("x"), "y"); err != nil {
+		t.Fatalf("publish at least once got error %q [%T]", err, err)
+	}
+	if _, err := client.PublishExactlyOnce([]byte("x"), "y"); err != nil {
+		t.Fatalf("publish exactly once got error %q [%T]", err, err)
+	}
+	if _, err := client.PublishAtLeastOnceRetained([]byte("x"), "y"); err != nil {
+		t.Fatalf("publish at least once retained got error %q [%T]", err, err)
+	}
+	if len(warns) != 1 {
+		t.Errorf("got %d warnings %q, want 1", len(warns), warns)
+	}
+}
+
+func TestOutboundBacklog(t *testing.T) {
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("dialer call not allowed for test")
+		},
+		AtLeastOnceMax: 2,
+		ExactlyOnceMax: 2,
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	if s := client.Stats(); s.OutboundQueueLen != 0 || s.OldestQueuedAge != 0 {
+		t.Errorf("initial stats got queue length %d and age %s, want 0 and 0", s.OutboundQueueLen, s.OldestQueuedAge)
+	}
+
+	publishStart := time.Now()
+	if _, err := client.PublishAtLeastOnce([]byte("x"), "y"); err != nil {
+		t.Fatalf("publish at least once got error %q [%T]", err, err)
+	}
+	firstDone := time.Now()
+	if _, err := client.PublishExactlyOnce([]byte("x"), "y"); err != nil {
+		t.Fatalf("publish exactly once got error %q [%T]", err, err)
+	}
+	statsStart := time.Now()
+	s1 := client.Stats()
+	// the first publish is the oldest
+	minAge, maxAge := statsStart.Sub(firstDone), time.Since(publishStart)
+	if s1.OutboundQueueLen != 2 {
+		t.Errorf("got queue length %d, want 2", s1.OutboundQueueLen)
+	}
+	if s1.OldestQueuedAge < minAge || s1.OldestQueuedAge > maxAge {
+		t.Errorf("got oldest age %s, want in range [%s, %s]", s1.OldestQueuedAge, minAge, maxAge)
+	}
+
+	s2 := client.Stats()
+	if s2.OutboundQueueLen != 2 {
+		t.Errorf("got queue length %d, want 2", s2.OutboundQueueLen)
+	}
+	if s2.OldestQueuedAge < s1.OldestQueuedAge {
+		t.Errorf("oldest age went from %s to %s, want no decline", s1.OldestQueuedAge, s2.OldestQueuedAge)
+	}
+}
@@ -0,0 +1,198 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RouterBackoff is the pause of Run after each error without Router.Error.
+const routerBackoff = time.Second
+
+// Router dispatches inbound messages from a Client to handlers per topic
+// filter. Subscription remains the responsibility of the application.
+type Router struct {
+	client *Client
+
+	// Default receives each message without any handler match. Nil
+	// discards.
+	Default func(topic string, message []byte)
+
+	// Big receives each BigMessage, with its Client in the read window.
+	// Nil reads BigMessage in full, and it dispatches the message like
+	// any other.
+	Big func(big *BigMessage)
+
+	// Error receives each error from ReadSlices, with BigMessage and
+	// ErrClosed as exceptions. Run blocks on Error, which makes it a good
+	// spot to apply backoff. Nil discards the error, with a backoff of one
+	// second, unless Config.AutoReconnect applies a backoff already.
+	Error func(err error)
+
+	mutex  sync.Mutex
+	routes []*route // in order of appearance
+}
+
+type route struct {
+	topicFilter string
+	accept      func(topic string, message []byte) bool // optional
+	handler     func(topic string, message []byte)
+}
+
+// NewRouter returns a new Router for the messages of client.
+func NewRouter(client *Client) *Router {
+	return &Router{client: client}
+}
+
+// HandleFunc registers f for each message which matches topicFilter. Messages
+// go to each matching handler, in order of registration. The message is only
+// valid during the call. HandleFunc panics on an illegal topic filter.
+func (r *Router) HandleFunc(topicFilter string, f func(topic string, message []byte)) {
+	r.HandleFuncIf(topicFilter, nil, f)
+}
+
+// HandleFuncIf is like HandleFunc, but messages go to f only when accept
+// approves, e.g., on a payload prefix. Rejected messages are dropped, which
+// excludes them from Default too. The filtering is client-side only. The
+// broker still sends each message which matches a subscription. A nil accept
+// approves all.
+func (r *Router) HandleFuncIf(topicFilter string, accept func(topic string, message []byte) bool, f func(topic string, message []byte)) {
+	if err := ValidateTopicFilter(topicFilter); err != nil {
+		panic(err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.routes = append(r.routes, &route{topicFilter, accept, f})
+}
+
+// Message is a copy of an inbound message.
+type Message struct {
+	Topic   string
+	Message []byte
+}
+
+// SubscribeScoped subscribes to topicFilter with a quality-of-service limit of
+// levelMax, and it returns the matching messages on a channel, which blocks Run
+// until receive. Cancelation of ctx removes the route, it closes the channel,
+// and it sends an UNSUBSCRIBE request, regardless of any message reception. Errors from the UNSUBSCRIBE request are
+// discarded. Messages with multiple matching routes go to each of them, and
+// they do not reach Default. SubscribeScoped panics on an illegal topic filter.
+func (r *Router) SubscribeScoped(ctx context.Context, topicFilter string, levelMax byte) (<-chan Message, error) {
+	if err := ValidateTopicFilter(topicFilter); err != nil {
+		panic(err)
+	}
+
+	ch := make(chan Message)
+	var closeMutex sync.Mutex // serializes the close of ch
+	var closed bool
+	scope := &route{topicFilter: topicFilter, handler: func(topic string, message []byte) {
+		closeMutex.Lock()
+		defer closeMutex.Unlock()
+		if closed {
+			return
+		}
+		m := Message{Topic: topic, Message: append([]byte(nil), message...)}
+		select {
+		case ch <- m:
+		case <-ctx.Done():
+		}
+	}}
+
+	// register before the subscription to catch the first message
+	r.mutex.Lock()
+	r.routes = append(r.routes, scope)
+	r.mutex.Unlock()
+
+	_, err := r.client.SubscribeLevels(ctx.Done(), []string{topicFilter}, []byte{levelMax})
+	if err != nil {
+		r.remove(scope)
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		r.remove(scope)
+		closeMutex.Lock()
+		closed = true
+		close(ch)
+		closeMutex.Unlock()
+
+		_ = r.client.Unsubscribe(nil, topicFilter)
+	}()
+	return ch, nil
+}
+
+// Remove unregisters a route. Dispatch works on snapshots of the routes, which
+// need a new slice for each removal.
+func (r *Router) remove(x *route) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	routes := make([]*route, 0, len(r.routes))
+	for _, route := range r.routes {
+		if route != x {
+			routes = append(routes, route)
+		}
+	}
+	r.routes = routes
+}
+
+// Run invokes ReadSlices on the Client until ErrClosed, which makes it the
+// read routine. Handlers are invoked from the routine of Run.
+func (r *Router) Run() {
+	for {
+		message, topic, err := r.client.ReadSlices()
+		var big *BigMessage
+		switch {
+		case err == nil:
+			r.dispatch(string(topic), message)
+
+		case errors.As(err, &big):
+			if r.Big != nil {
+				r.Big(big)
+				break
+			}
+			message, err := big.ReadAll()
+			if err != nil {
+				r.error(err)
+				break
+			}
+			r.dispatch(big.Topic, message)
+
+		case errors.Is(err, ErrClosed):
+			return
+
+		default:
+			r.error(err)
+		}
+	}
+}
+
+func (r *Router) error(err error) {
+	switch {
+	case r.Error != nil:
+		r.Error(err)
+	case !r.client.AutoReconnect:
+		// prevent a busy loop on the Dialer
+		time.Sleep(routerBackoff)
+	}
+}
+
+func (r *Router) dispatch(topic string, message []byte) {
+	var matchN int
+	r.mutex.Lock()
+	routes := r.routes
+	r.mutex.Unlock()
+	for _, route := range routes {
+		if !TopicMatch(route.topicFilter, topic) {
+			continue
+		}
+		matchN++
+		if route.accept == nil || route.accept(topic, message) {
+			route.handler(topic, message)
+		}
+	}
+	if matchN == 0 && r.Default != nil {
+		r.Default(topic, message)
+	}
+}
@@ -0,0 +1,287 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket frame operation codes, from RFC 6455, subsection 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WsAcceptGUID is the fixed key suffix from RFC 6455, subsection 1.3.
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// NewWebSocketDialer provides connections over WebSocket, with the URL scheme
+// either "ws" or "wss". The config applies to "wss" only, and it may be nil.
+// MQTT packets go in binary messages with the "mqtt" subprotocol, as described
+// in MQTT Version 3.1.1, subsection 6.0. Each write gets its own message, which
+// may contain a partial packet, as permitted by the specification.
+func NewWebSocketDialer(wsURL string, config *tls.Config) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		u, err := url.Parse(wsURL)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt: WebSocket URL unusable: %w", err)
+		}
+		address := u.Host
+		var dial Dialer
+		switch u.Scheme {
+		case "ws":
+			if u.Port() == "" {
+				address = net.JoinHostPort(u.Hostname(), "80")
+			}
+			dial = NewDialer("tcp", address)
+		case "wss":
+			if u.Port() == "" {
+				address = net.JoinHostPort(u.Hostname(), "443")
+			}
+			dial = NewTLSDialer("tcp", address, config)
+		default:
+			return nil, fmt.Errorf("mqtt: WebSocket URL scheme %q not supported", u.Scheme)
+		}
+
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ws, err := wsHandshake(ctx, conn, u)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ws, nil
+	}
+}
+
+// WsHandshake applies the opening handshake from RFC 6455, section 4.
+func wsHandshake(ctx context.Context, conn net.Conn, u *url.URL) (*wsConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	path := u.RequestURI()
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Protocol: mqtt\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, fmt.Errorf("mqtt: WebSocket handshake: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: WebSocket handshake: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("mqtt: WebSocket handshake got HTTP status %q", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("mqtt: WebSocket handshake without upgrade")
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errors.New("mqtt: WebSocket handshake with wrong accept key")
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "mqtt" {
+		return nil, fmt.Errorf("mqtt: WebSocket handshake got subprotocol %q, want \"mqtt\"", p)
+	}
+	return &wsConn{Conn: conn, r: r}, nil
+}
+
+// WsConn frames writes as binary messages, and it reads the payload of
+// binary messages as a continuous stream.
+type wsConn struct {
+	net.Conn
+
+	r         *bufio.Reader // Conn buffered
+	remaining uint64        // pending payload bytes in the current frame
+	mask      [4]byte       // from the current frame, if masked
+	masked    bool          // servers should not mask
+	maskN     int           // payload bytes read in the current frame
+
+	writeMutex sync.Mutex // frames are atomic
+}
+
+// Read implements the io.Reader interface.
+func (ws *wsConn) Read(p []byte) (n int, err error) {
+	for ws.remaining == 0 {
+		if err := ws.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > ws.remaining {
+		p = p[:ws.remaining]
+	}
+	n, err = ws.r.Read(p)
+	ws.remaining -= uint64(n)
+	if ws.masked {
+		for i := range p[:n] {
+			p[i] ^= ws.mask[(ws.maskN+i)&3]
+		}
+		ws.maskN += n
+	}
+	return n, err
+}
+
+// NextFrame reads frame headers until a payload for data is pending.
+// Control frames are handled in place. Headers are only consumed once they
+// are complete, such that read deadlines can not split them.
+func (ws *wsConn) nextFrame() error {
+	head, err := ws.r.Peek(2)
+	if err != nil {
+		if len(head) != 0 {
+			return wsUnexpectedEOF(err)
+		}
+		return err
+	}
+	opcode := head[0] & 0xf
+	headSize := 2
+	switch head[1] & 0x7f {
+	case 126:
+		headSize += 2
+	case 127:
+		headSize += 8
+	}
+	masked := head[1]&0x80 != 0
+	if masked {
+		headSize += 4
+	}
+	head, err = ws.r.Peek(headSize)
+	if err != nil {
+		return wsUnexpectedEOF(err)
+	}
+
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(head[2:]))
+	case 127:
+		size = binary.BigEndian.Uint64(head[2:])
+	}
+	var mask [4]byte
+	if masked {
+		copy(mask[:], head[headSize-4:])
+	}
+
+	switch opcode {
+	case wsContinuation, wsBinary:
+		ws.r.Discard(headSize)
+		ws.remaining = size
+		ws.mask = mask
+		ws.masked = masked
+		ws.maskN = 0
+		return nil
+	case wsClose:
+		return io.EOF
+	case wsPing, wsPong:
+		if size > 125 {
+			return fmt.Errorf("mqtt: WebSocket control frame with %d byte payload", size)
+		}
+		frame, err := ws.r.Peek(headSize + int(size))
+		if err != nil {
+			return wsUnexpectedEOF(err)
+		}
+		payload := append([]byte(nil), frame[headSize:]...)
+		ws.r.Discard(len(frame))
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i&3]
+			}
+		}
+		if opcode == wsPing {
+			if _, err := ws.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	case wsText:
+		return errors.New("mqtt: WebSocket text frame denied")
+	default:
+		return fmt.Errorf("mqtt: WebSocket frame with reserved opcode %#x", opcode)
+	}
+}
+
+func wsUnexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Write implements the io.Writer interface.
+func (ws *wsConn) Write(p []byte) (n int, err error) {
+	return ws.writeFrame(wsBinary, p)
+}
+
+// WriteFrame sends a single (final) frame, and it returns the number of payload
+// bytes sent. Clients must mask their frames. A frame which was sent in part
+// can not be continued, so the connection is closed on such error.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) (n int, err error) {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, 0x80|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, 0x80|126, byte(size>>8), byte(size))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(size))
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+		return 0, err
+	}
+	frame = append(frame, mask[:]...)
+	headSize := len(frame)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	n, err = ws.Conn.Write(frame)
+	if err != nil && n != 0 {
+		ws.Conn.Close() // frame broken
+	}
+	n -= headSize
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}